@@ -162,7 +162,7 @@ func TestTailFileErrorReporting(t *testing.T) {
 	ch := make(chan LogLine, 10)
 
 	// Try to tail a non-existent file
-	go tailFile(ctx, "/nonexistent/file/path", ch)
+	go tailFile(ctx, "test", "/nonexistent/file/path", ch, nil)
 
 	// Wait for context to timeout
 	<-ctx.Done()
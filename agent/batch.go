@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// BatchConfig bounds the batches of a stream. Zero fields use the defaults.
+type BatchConfig struct {
+	MaxEvents int           `yaml:"max_events,omitempty"` // Events per batch (default 100)
+	MaxBytes  int           `yaml:"max_bytes,omitempty"`  // Encoded NDJSON bytes per batch (default and maximum 1 MiB)
+	Linger    time.Duration `yaml:"linger,omitempty"`     // How long the first event of a batch waits for more (default 2s)
+}
+
+const (
+	// minBatchBytes keeps max_bytes large enough for an event's metadata.
+	minBatchBytes = 1024
+	// ingestPayloadLimit is the largest NDJSON payload the ingest API
+	// accepts. It caps max_bytes, and a single event over it is truncated.
+	ingestPayloadLimit = 1 << 20
+)
+
+// withDefaults fills unset fields with the defaults.
+func (bc BatchConfig) withDefaults() BatchConfig {
+	if bc.MaxEvents <= 0 {
+		bc.MaxEvents = maxBatchEvents
+	}
+	if bc.MaxBytes <= 0 {
+		bc.MaxBytes = maxBatchBytes
+	}
+	if bc.MaxBytes < minBatchBytes {
+		bc.MaxBytes = minBatchBytes
+	}
+	if bc.MaxBytes > ingestPayloadLimit {
+		bc.MaxBytes = ingestPayloadLimit
+	}
+	if bc.Linger <= 0 {
+		bc.Linger = batchLinger
+	}
+	return bc
+}
+
+// encodedSize is the number of bytes ev takes in an NDJSON payload.
+func encodedSize(ev Event) int {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return 0
+	}
+	return len(data) + 1
+}
+
+// truncateEvent makes an event over the ingest payload limit fit in
+// maxBytes. The rule: the parsed fields are dropped and the raw line is cut
+// at a character boundary, with `truncated` and the original line length
+// recorded. JSON object events become plain events holding the object's
+// text, cut the same way. It returns the event and its encoded size.
+func truncateEvent(ev Event, maxBytes int) (Event, int) {
+	var e LogEvent
+	switch x := ev.(type) {
+	case LogEvent:
+		e = x
+	case JSONEvent:
+		obj, err := json.Marshal(x.Object)
+		if err != nil {
+			return ev, encodedSize(ev)
+		}
+		e = LogEvent{
+			Log:        string(obj),
+			Filename:   x.Meta.Filename,
+			ObservedAt: x.Meta.ObservedAt,
+			Timestamp:  x.Meta.Timestamp,
+			Labels:     x.Meta.Labels,
+		}
+	default:
+		return ev, encodedSize(ev)
+	}
+
+	line := e.Log
+	e.Fields = nil
+	e.Truncated = true
+	e.OriginalBytes = len(line)
+	e.Log = ""
+	budget := maxBytes - encodedSize(e)
+
+	// JSON escaping can make the encoded line longer than the raw one, so
+	// search for the longest prefix whose encoded event fits
+	lo, hi := 0, min(budget, len(line))
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		e.Log = validPrefix(line, mid)
+		if encodedSize(e) <= maxBytes {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	e.Log = validPrefix(line, max(lo, 0))
+	return e, encodedSize(e)
+}
+
+// validPrefix returns at most n bytes of s, cut at a character boundary.
+func validPrefix(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
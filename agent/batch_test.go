@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBatchConfigDefaults(t *testing.T) {
+	cfg := BatchConfig{}.withDefaults()
+	if cfg.MaxEvents != maxBatchEvents || cfg.MaxBytes != maxBatchBytes || cfg.Linger != batchLinger {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+	if cfg := (BatchConfig{MaxBytes: 10}).withDefaults(); cfg.MaxBytes != minBatchBytes {
+		t.Errorf("expected a tiny max_bytes to be raised to %d, got %d", minBatchBytes, cfg.MaxBytes)
+	}
+	if cfg := (BatchConfig{MaxBytes: 4 << 20}).withDefaults(); cfg.MaxBytes != ingestPayloadLimit {
+		t.Errorf("expected max_bytes to be capped at %d, got %d", ingestPayloadLimit, cfg.MaxBytes)
+	}
+}
+
+func TestTruncateEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"ascii", strings.Repeat("a", 5000)},
+		{"multibyte", strings.Repeat("日本語", 2000)},
+		{"escaped", strings.Repeat(`"\`+"\x01", 2000)},
+	}
+	for _, tt := range tests {
+		ev := LogEvent{Log: tt.line, Filename: "/app.log", Fields: &AccessFields{Status: 200}}
+		got, size := truncateEvent(ev, 2048)
+		e := got.(LogEvent)
+
+		if size > 2048 || size != encodedSize(e) {
+			t.Errorf("%s: encoded size %d (reported %d), want at most 2048", tt.name, encodedSize(e), size)
+		}
+		if !e.Truncated || e.OriginalBytes != len(tt.line) || e.Fields != nil {
+			t.Errorf("%s: expected truncation markers and no fields, got %+v", tt.name, e)
+		}
+		if !strings.HasPrefix(tt.line, e.Log) || !utf8.ValidString(e.Log) || len(e.Log) < 500 {
+			t.Errorf("%s: expected a valid prefix of the line, got %d bytes", tt.name, len(e.Log))
+		}
+	}
+}
+
+func TestTruncateJSONEvent(t *testing.T) {
+	ll := LogLine{File: "/app.log", Line: `{"msg":"` + strings.Repeat("x", 5000) + `"}`, Labels: map[string]string{"app": "api"}}
+	ev, _ := parseLineFormat(ll, formatJSON)
+
+	got, size := truncateEvent(ev, 2048)
+	e, ok := got.(LogEvent)
+	if !ok {
+		t.Fatalf("expected a plain event, got %T", got)
+	}
+	if size > 2048 || !e.Truncated || !strings.HasPrefix(e.Log, `{"msg":"xxx`) || e.Labels["app"] != "api" {
+		t.Errorf("unexpected truncated event (%d bytes): %+v", size, e)
+	}
+}
+
+func TestPipelineSplitsBatchesByBytes(t *testing.T) {
+	p := newPipeline(StreamConfig{Name: "app", Batch: BatchConfig{MaxBytes: 4096}}, nil, nil)
+	in := make(chan LogLine, 10)
+	out := make(chan pendingBatch, 10)
+	line := strings.Repeat("a", 1500)
+	for i := 1; i <= 5; i++ {
+		in <- LogLine{File: "/app.log", Line: line, Pos: FilePosition{Offset: int64(i * 1501)}}
+	}
+	in <- LogLine{File: "/app.log", Line: strings.Repeat("b", 10000), Pos: FilePosition{Offset: 99999}}
+	close(in)
+	p.batch(in, out)
+	close(out)
+
+	var batches []pendingBatch
+	for b := range out {
+		batches = append(batches, b)
+	}
+	if len(batches) != 4 {
+		t.Fatalf("expected 2+2+1 regular events and the oversized one alone, got %d batches", len(batches))
+	}
+	for i, b := range batches[:3] {
+		if b.size > 4096 || b.size != len(encodeNDJSON(b.events)) {
+			t.Errorf("batch %d: size %d (encoded %d), want at most 4096", i+1, b.size, len(encodeNDJSON(b.events)))
+		}
+	}
+	// Each batch commits the position of its own last event only
+	for i, want := range []int64{2 * 1501, 4 * 1501, 5 * 1501, 99999} {
+		if got := batches[i].positions["/app.log"].Offset; got != want {
+			t.Errorf("batch %d: position %d, want %d", i+1, got, want)
+		}
+	}
+	// max_bytes decides batching only; the event is shipped whole
+	if e := batches[3].events[0].(LogEvent); len(batches[3].events) != 1 || e.Truncated || len(e.Log) != 10000 {
+		t.Errorf("expected the oversized event to be shipped whole and alone, got %+v", batches[3].events)
+	}
+}
+
+func TestPipelineTruncatesEventsOverIngestLimit(t *testing.T) {
+	p := newPipeline(StreamConfig{Name: "app"}, nil, nil)
+	in := make(chan LogLine, 2)
+	out := make(chan pendingBatch, 2)
+	in <- LogLine{File: "/app.log", Line: strings.Repeat("a", ingestPayloadLimit+100)}
+	close(in)
+	p.batch(in, out)
+	close(out)
+
+	b := <-out
+	e := b.events[0].(LogEvent)
+	if !e.Truncated || e.OriginalBytes != ingestPayloadLimit+100 || b.size > ingestPayloadLimit {
+		t.Errorf("expected the event to be truncated to the ingest payload limit, got %d bytes, truncated=%v", b.size, e.Truncated)
+	}
+}
+
+func TestPipelineBatchEventsAndLinger(t *testing.T) {
+	srv, batches := countingServer(t, nil)
+	p := startPipeline(t, StreamConfig{Name: "test", StreamID: "test", URL: srv.URL,
+		Batch: BatchConfig{MaxEvents: 3, Linger: 100 * time.Millisecond}})
+
+	for i := 0; i < 4; i++ {
+		p.lines <- LogLine{File: "/test.log", Line: "line"}
+	}
+	for _, want := range []int{3, 1} {
+		select {
+		case n := <-batches:
+			if n != want {
+				t.Errorf("expected a batch of %d events, got %d", want, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a batch of %d events within the linger time", want)
+		}
+	}
+}
+
+func TestEncodedSizeMatchesNDJSON(t *testing.T) {
+	ev := LogEvent{Log: `say "hi"`, Filename: "/app.log"}
+	data, _ := json.Marshal(ev)
+	if encodedSize(ev) != len(data)+1 || encodedSize(ev) != len(encodeNDJSON([]Event{ev})) {
+		t.Errorf("encodedSize = %d, NDJSON line is %d bytes", encodedSize(ev), len(encodeNDJSON([]Event{ev})))
+	}
+}
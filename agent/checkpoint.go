@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	checkpointFile  = "checkpoints.json"
+	fingerprintSize = 1024
+)
+
+// FilePosition identifies a read position inside a specific file instance.
+// Dev and Inode pin the position to one file even if its path is reused,
+// and the fingerprint (a hash of the first bytes) guards against inode reuse.
+type FilePosition struct {
+	Dev            uint64 `json:"dev"`
+	Inode          uint64 `json:"inode"`
+	Offset         int64  `json:"offset"`
+	Fingerprint    string `json:"fingerprint,omitempty"`
+	FingerprintLen int    `json:"fingerprint_len,omitempty"`
+}
+
+// Checkpoint is the persisted position for a tailed path.
+type Checkpoint struct {
+	FilePosition
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registry keeps per-file checkpoints and persists them to the state directory.
+// Checkpoints are kept per stream: a file matched by two streams is read by
+// two tailers, and each may only resume past the lines its own stream shipped.
+// A nil *Registry is valid and simply does not persist anything.
+type Registry struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]map[string]Checkpoint // stream name -> path -> checkpoint
+	// legacy holds the per-path checkpoints of a registry written before
+	// they were kept per stream. A stream without its own checkpoint for a
+	// path resumes from it, and the first commit for the path retires it.
+	legacy map[string]Checkpoint
+}
+
+// registryFile is the layout of the checkpoint file.
+type registryFile struct {
+	Version int                              `json:"version"`
+	Streams map[string]map[string]Checkpoint `json:"streams"`
+	Legacy  map[string]Checkpoint            `json:"legacy,omitempty"`
+}
+
+const registryVersion = 2
+
+// openRegistry loads the checkpoint registry from dir, creating it if needed.
+func openRegistry(dir string) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	reg := &Registry{
+		path:    filepath.Join(dir, checkpointFile),
+		entries: make(map[string]map[string]Checkpoint),
+		legacy:  make(map[string]Checkpoint),
+	}
+
+	b, err := os.ReadFile(reg.path)
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rf registryFile
+	if err = json.Unmarshal(b, &rf); err == nil && rf.Version == 0 {
+		// The first layout mapped paths straight to checkpoints
+		err = json.Unmarshal(b, &rf.Legacy)
+	}
+	if err != nil {
+		// A corrupt registry must not stop the agent; start fresh instead.
+		log.Printf("WARNING: ignoring unreadable checkpoint file %s: %v", reg.path, err)
+		return reg, nil
+	}
+	for stream, paths := range rf.Streams {
+		reg.entries[stream] = paths
+	}
+	for path, cp := range rf.Legacy {
+		reg.legacy[path] = cp
+	}
+	return reg, nil
+}
+
+// Get returns the checkpoint stored for path in stream.
+func (r *Registry) Get(stream, path string) (Checkpoint, bool) {
+	if r == nil {
+		return Checkpoint{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cp, ok := r.entries[stream][path]; ok {
+		return cp, true
+	}
+	cp, ok := r.legacy[path]
+	return cp, ok
+}
+
+// Find returns the most recent checkpoint of stream taken from the file
+// instance dev/ino, whatever path it was read under: a rotated file keeps
+// its inode but moves to a new name.
+func (r *Registry) Find(stream string, dev, ino uint64) (Checkpoint, bool) {
+	if r == nil {
+		return Checkpoint{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found Checkpoint
+	ok := false
+	for _, cps := range []map[string]Checkpoint{r.entries[stream], r.legacy} {
+		for _, cp := range cps {
+			if cp.Dev == dev && cp.Inode == ino && (!ok || cp.UpdatedAt.After(found.UpdatedAt)) {
+				found, ok = cp, true
+			}
+		}
+	}
+	return found, ok
+}
+
+// Commit records pos as fully shipped by stream for path and writes the
+// registry to disk.
+func (r *Registry) Commit(stream, path string, pos FilePosition) error {
+	return r.CommitAll(stream, map[string]FilePosition{path: pos})
+}
+
+// CommitAll records several positions of stream with a single write to disk.
+func (r *Registry) CommitAll(stream string, positions map[string]FilePosition) error {
+	if r == nil || len(positions) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths := r.entries[stream]
+	if paths == nil {
+		paths = make(map[string]Checkpoint)
+		r.entries[stream] = paths
+	}
+	now := time.Now().UTC()
+	for path, pos := range positions {
+		paths[path] = Checkpoint{FilePosition: pos, UpdatedAt: now}
+		delete(r.legacy, path)
+	}
+	return r.save()
+}
+
+// save atomically replaces the registry file. Callers must hold r.mu.
+func (r *Registry) save() error {
+	b, err := json.MarshalIndent(registryFile{Version: registryVersion, Streams: r.entries, Legacy: r.legacy}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// fileIdentity returns the device and inode numbers for a file.
+func fileIdentity(fi os.FileInfo) (dev, ino uint64) {
+	if sys := fi.Sys(); sys != nil {
+		if st, ok := sys.(*syscall.Stat_t); ok {
+			return uint64(st.Dev), uint64(st.Ino)
+		}
+	}
+	return 0, 0
+}
+
+// fingerprint hashes the first n bytes of f without moving its read offset.
+func fingerprint(f *os.File, n int64) (string, int, error) {
+	if n > fingerprintSize {
+		n = fingerprintSize
+	}
+	buf := make([]byte, n)
+	read, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	sum := sha256.Sum256(buf[:read])
+	return hex.EncodeToString(sum[:]), read, nil
+}
+
+// refreshFingerprint extends the fingerprint while the file is still shorter
+// than fingerprintSize, so it always covers the bytes already read.
+func (p *FilePosition) refreshFingerprint(f *os.File) {
+	if p.FingerprintLen >= fingerprintSize || p.Offset <= int64(p.FingerprintLen) {
+		return
+	}
+	if fp, n, err := fingerprint(f, p.Offset); err == nil {
+		p.Fingerprint = fp
+		p.FingerprintLen = n
+	}
+}
+
+// matches reports whether f is the same file instance the checkpoint was taken from.
+func (cp Checkpoint) matches(f *os.File, fi os.FileInfo) bool {
+	dev, ino := fileIdentity(fi)
+	if dev != cp.Dev || ino != cp.Inode || fi.Size() < cp.Offset {
+		return false
+	}
+	if cp.FingerprintLen == 0 {
+		return true
+	}
+	fp, n, err := fingerprint(f, int64(cp.FingerprintLen))
+	return err == nil && n == cp.FingerprintLen && fp == cp.Fingerprint
+}
+
+// startPosition decides where tailing of a freshly opened file begins and
+// seeks f there. Files with a matching checkpoint for stream resume where
+// shipping left off; files that changed since the checkpoint are read from
+// the start; files never seen before start at the end, as they always have.
+func startPosition(f *os.File, stream, file string, reg *Registry) (FilePosition, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return FilePosition{}, err
+	}
+	dev, ino := fileIdentity(fi)
+	pos := FilePosition{Dev: dev, Inode: ino, Offset: fi.Size()}
+
+	if cp, ok := reg.Get(stream, file); ok {
+		if cp.matches(f, fi) {
+			pos.Offset = cp.Offset
+			if cp.Offset < fi.Size() {
+				log.Printf("RESUME: %s from offset %d (%d bytes behind)", file, cp.Offset, fi.Size()-cp.Offset)
+			}
+		} else {
+			log.Printf("RESUME: %s changed since last checkpoint, reading from start", file)
+			pos.Offset = 0
+		}
+	}
+
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return FilePosition{}, err
+	}
+	pos.refreshFingerprint(f)
+	return pos, nil
+}
+
+// resolveStateDir picks the directory used for checkpoints and other agent state.
+// Order: state_dir from config, TAILSTREAM_STATE_DIR, the system location,
+// then a per-user cache directory when the system location is not writable.
+func resolveStateDir(cfg Config) string {
+	if cfg.StateDir != "" {
+		return cfg.StateDir
+	}
+	if dir := os.Getenv("TAILSTREAM_STATE_DIR"); dir != "" {
+		return dir
+	}
+
+	systemDir := getSystemStateDir()
+	if err := os.MkdirAll(systemDir, 0o750); err == nil && checkWritePermission(systemDir) == nil {
+		return systemDir
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cacheDir, "tailstream")
+	}
+	return systemDir
+}
+
+// openStateRegistry opens the checkpoint registry in dir. Failure to open it
+// is not fatal: the agent keeps running without persisted offsets.
+func openStateRegistry(dir string) *Registry {
+	reg, err := openRegistry(dir)
+	if err != nil {
+		log.Printf("WARNING: cannot use state directory %s: %v - read offsets will not survive restarts", dir, err)
+		return nil
+	}
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("Using state directory %s", dir)
+	}
+	return reg
+}
+
+// getSystemStateDir returns the default state directory for the OS
+func getSystemStateDir() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "/var/lib/tailstream"
+	default:
+		// Other platforms - use current directory
+		return ".tailstream-state"
+	}
+}
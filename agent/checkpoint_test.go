@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	reg, err := openRegistry(dir)
+	if err != nil {
+		t.Fatalf("openRegistry: %v", err)
+	}
+	pos := FilePosition{Dev: 1, Inode: 42, Offset: 1234, Fingerprint: "abc", FingerprintLen: 3}
+	if err := reg.Commit("test", "/var/log/nginx/access.log", pos); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// A second registry opened on the same directory sees the saved checkpoint
+	reloaded, err := openRegistry(dir)
+	if err != nil {
+		t.Fatalf("reopen registry: %v", err)
+	}
+	cp, ok := reloaded.Get("test", "/var/log/nginx/access.log")
+	if !ok {
+		t.Fatal("expected checkpoint to survive reload")
+	}
+	if cp.FilePosition != pos {
+		t.Errorf("expected %+v, got %+v", pos, cp.FilePosition)
+	}
+	if cp.UpdatedAt.IsZero() {
+		t.Error("expected UpdatedAt to be set")
+	}
+}
+
+// TestRegistryKeepsStreamsApart covers a file matched by two streams: the
+// stream that is ahead must not move the other's checkpoint.
+func TestRegistryKeepsStreamsApart(t *testing.T) {
+	dir := t.TempDir()
+	reg, err := openRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const file = "/var/log/app.log"
+	if err := reg.Commit("errors", file, FilePosition{Inode: 7, Offset: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Commit("everything", file, FilePosition{Inode: 7, Offset: 900}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := openRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stream, want := range map[string]int64{"errors": 100, "everything": 900} {
+		if cp, ok := reloaded.Get(stream, file); !ok || cp.Offset != want {
+			t.Errorf("stream %s: expected offset %d, got %+v (found=%v)", stream, want, cp, ok)
+		}
+	}
+	if _, ok := reloaded.Get("other", file); ok {
+		t.Error("expected no checkpoint for a stream that never shipped the file")
+	}
+}
+
+func TestRegistryFindsRenamedFiles(t *testing.T) {
+	reg, err := openRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Commit("app", "/var/log/app.log", FilePosition{Dev: 1, Inode: 7, Offset: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if cp, ok := reg.Find("app", 1, 7); !ok || cp.Offset != 100 {
+		t.Errorf("expected the checkpoint taken under the old name, got %+v (found=%v)", cp, ok)
+	}
+	if _, ok := reg.Find("app", 1, 8); ok {
+		t.Error("expected no checkpoint for another inode")
+	}
+	if _, ok := reg.Find("other", 1, 7); ok {
+		t.Error("expected no checkpoint for a stream that never shipped the file")
+	}
+}
+
+// TestRegistryReadsLegacyLayout upgrades a registry that mapped paths
+// straight to checkpoints: every stream resumes from the old entry until it
+// commits its own.
+func TestRegistryReadsLegacyLayout(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"/var/log/app.log": {"dev": 1, "inode": 42, "offset": 500, "updated_at": "2024-01-15T10:30:45Z"}}`
+	if err := os.WriteFile(filepath.Join(dir, checkpointFile), []byte(legacy), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range []string{"a", "b"} {
+		if cp, ok := reg.Get(stream, "/var/log/app.log"); !ok || cp.Inode != 42 || cp.Offset != 500 {
+			t.Errorf("stream %s: expected the legacy checkpoint, got %+v (found=%v)", stream, cp, ok)
+		}
+	}
+
+	if err := reg.Commit("a", "/var/log/app.log", FilePosition{Dev: 1, Inode: 42, Offset: 600}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := openRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp, _ := reloaded.Get("a", "/var/log/app.log"); cp.Offset != 600 {
+		t.Errorf("expected the stream's own checkpoint after a commit, got %+v", cp)
+	}
+	if _, ok := reloaded.Get("b", "/var/log/app.log"); ok {
+		t.Error("expected the legacy checkpoint to be retired by the first commit")
+	}
+}
+
+func TestRegistryCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, checkpointFile), []byte("{not json"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openRegistry(dir)
+	if err != nil {
+		t.Fatalf("corrupt registry should not be fatal: %v", err)
+	}
+	if _, ok := reg.Get("test", "anything"); ok {
+		t.Error("expected empty registry after corrupt file")
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var reg *Registry
+	if _, ok := reg.Get("test", "/tmp/x.log"); ok {
+		t.Error("nil registry should have no checkpoints")
+	}
+	if err := reg.Commit("test", "/tmp/x.log", FilePosition{Offset: 1}); err != nil {
+		t.Errorf("nil registry Commit should be a no-op, got %v", err)
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "app.log")
+	content := "line one\nline two\nline three\n"
+	if err := os.WriteFile(logFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openRegistry(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *os.File {
+		f, err := os.Open(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	t.Run("new file starts at end", func(t *testing.T) {
+		pos, err := startPosition(open(), "test", logFile, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos.Offset != int64(len(content)) {
+			t.Errorf("expected offset %d, got %d", len(content), pos.Offset)
+		}
+		if pos.FingerprintLen != len(content) {
+			t.Errorf("expected fingerprint over %d bytes, got %d", len(content), pos.FingerprintLen)
+		}
+	})
+
+	t.Run("matching checkpoint resumes", func(t *testing.T) {
+		f := open()
+		pos, _ := startPosition(f, "test", logFile, nil)
+		pos.Offset = int64(len("line one\n"))
+		if err := reg.Commit("test", logFile, pos); err != nil {
+			t.Fatal(err)
+		}
+
+		resumed, err := startPosition(open(), "test", logFile, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed.Offset != pos.Offset {
+			t.Errorf("expected resume at %d, got %d", pos.Offset, resumed.Offset)
+		}
+	})
+
+	t.Run("changed fingerprint reads from start", func(t *testing.T) {
+		cp, _ := reg.Get("test", logFile)
+		cp.Fingerprint = "different"
+		if err := reg.Commit("test", logFile, cp.FilePosition); err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := startPosition(open(), "test", logFile, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos.Offset != 0 {
+			t.Errorf("expected offset 0 for changed file, got %d", pos.Offset)
+		}
+	})
+}
+
+// TestTailFileResumesFromCheckpoint simulates a restart: lines written while
+// the agent was down must be delivered once tailing starts again.
+func TestTailFileResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(logFile, []byte("shipped before restart\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openRegistry(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := startPosition(f, "test", logFile, nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Commit("test", logFile, pos); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written while the agent was "down"
+	appendFile(t, logFile, "written during downtime\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 10)
+	go tailFile(ctx, "test", logFile, ch, reg)
+
+	select {
+	case ll := <-ch:
+		if ll.Line != "written during downtime" {
+			t.Errorf("expected line written during downtime, got %q", ll.Line)
+		}
+		wantOffset := int64(len("shipped before restart\nwritten during downtime\n"))
+		if ll.Pos.Offset != wantOffset {
+			t.Errorf("expected position %d, got %d", wantOffset, ll.Pos.Offset)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tailFile did not deliver the line written during downtime")
+	}
+}
+
+func TestTailFileJoinsPartialLines(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "partial.log")
+	if err := os.WriteFile(logFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 10)
+	go tailFile(ctx, "test", logFile, ch, nil)
+
+	time.Sleep(300 * time.Millisecond)
+	appendFile(t, logFile, "first half ")
+	time.Sleep(300 * time.Millisecond)
+	appendFile(t, logFile, "second half\n")
+
+	select {
+	case ll := <-ch:
+		if ll.Line != "first half second half" {
+			t.Errorf("expected joined line, got %q", ll.Line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no line delivered")
+	}
+}
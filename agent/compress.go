@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"sync"
+	"time"
+)
+
+// Compression settings for StreamConfig.Compression.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// compressMinBytes is the smallest payload worth compressing; below it the
+// gzip header and trailer outweigh the savings.
+const compressMinBytes = 1024
+
+// encodingRetryAfter is how long an endpoint that rejected compressed
+// payloads is sent plain ones before compression is tried again.
+const encodingRetryAfter = time.Hour
+
+// encodingRejected records, by ingest URL, when an endpoint answered a
+// compressed request with 415 Unsupported Media Type.
+var encodingRejected sync.Map
+
+func validCompression(c string) bool {
+	switch c {
+	case "", compressionNone, compressionGzip:
+		return true
+	}
+	return false
+}
+
+// contentEncoding returns the Content-Encoding to send a payload of size n
+// to stream with, or "" to send it as is.
+func contentEncoding(stream StreamConfig, n int) string {
+	if stream.Compression != compressionGzip || n < compressMinBytes {
+		return ""
+	}
+	if since, ok := encodingRejected.Load(stream.GetURL()); ok && time.Since(since.(time.Time)) < encodingRetryAfter {
+		return ""
+	}
+	return compressionGzip
+}
+
+// rejectEncoding makes requests to stream go out uncompressed for a while.
+func rejectEncoding(stream StreamConfig, encoding string) {
+	if _, seen := encodingRejected.Swap(stream.GetURL(), time.Now()); !seen {
+		log.Printf("WARNING: Stream '%s' does not accept %s payloads - sending them uncompressed", stream.Name, encoding)
+	}
+}
+
+func gzipPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
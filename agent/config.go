@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,13 +14,21 @@ import (
 type Config struct {
 	Env string `yaml:"env"`
 
-	Discovery struct {
-		Enabled bool `yaml:"enabled"`
-		Paths   struct {
-			Include []string `yaml:"include"`
-			Exclude []string `yaml:"exclude"`
-		} `yaml:"paths"`
-	} `yaml:"discovery,omitempty"`
+	// Hostname is sent once per request, in a header describing the whole
+	// batch; defaults to the system hostname
+	Hostname string `yaml:"hostname,omitempty"`
+	// Labels are static key/value pairs sent once per request, like Hostname,
+	// for every stream
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// StateDir holds checkpoints and other data that must survive restarts.
+	// Defaults to /var/lib/tailstream on Linux.
+	StateDir string `yaml:"state_dir,omitempty"`
+
+	// ShutdownTimeout bounds how long pending batches are flushed on SIGTERM/SIGINT
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+
+	Discovery DiscoveryConfig `yaml:"discovery,omitempty"`
 
 	Updates struct {
 		Enabled       bool   `yaml:"enabled"`         // Enable automatic updates
@@ -26,10 +36,32 @@ type Config struct {
 		CheckHours    int    `yaml:"check_hours"`     // Hours between update checks
 	} `yaml:"updates"`
 
+	// Timeouts and connection reuse for all outbound HTTP requests
+	HTTP HTTPConfig `yaml:"http,omitempty"`
+
+	// Disk spool for batches that fail to ship
+	Spool SpoolConfig `yaml:"spool,omitempty"`
+
 	// Multi-stream configuration
 	Streams []StreamConfig `yaml:"streams,omitempty"`
 }
 
+// DiscoveryConfig controls how log files are found.
+type DiscoveryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Paths   struct {
+		Include []string `yaml:"include"`
+		Exclude []string `yaml:"exclude"`
+	} `yaml:"paths"`
+	// DefaultStream names the stream that receives files matched by
+	// Paths.Include that no stream's own paths claim
+	DefaultStream string `yaml:"default_stream,omitempty"`
+	// RescanInterval is how often stream globs are matched again to pick up new files
+	RescanInterval time.Duration `yaml:"rescan_interval,omitempty"`
+	// RetireAfter is how long a file must be gone before its tailer is stopped
+	RetireAfter time.Duration `yaml:"retire_after,omitempty"`
+}
+
 // StreamConfig defines a destination stream with its own settings
 type StreamConfig struct {
 	Name     string   `yaml:"name"`              // Human-readable name for this stream
@@ -38,6 +70,20 @@ type StreamConfig struct {
 	Key      string   `yaml:"key,omitempty"`     // Optional stream-specific access token
 	Paths    []string `yaml:"paths"`             // Log file patterns for this stream
 	Exclude  []string `yaml:"exclude,omitempty"` // Exclusion patterns for this stream
+
+	Retry RetryConfig `yaml:"retry,omitempty"` // Delivery retry policy for this stream
+
+	Multiline MultilineConfig   `yaml:"multiline,omitempty"` // Rules for joining lines such as stack traces into one event
+	Format    string            `yaml:"format,omitempty"`    // Parse lines as combined, common, caddy or json; raw when empty
+	Timestamp TimestampConfig   `yaml:"timestamp,omitempty"` // How to extract the time an event happened
+	Labels    map[string]string `yaml:"labels,omitempty"`    // Static labels for this stream, sent with the global ones
+	Filters   []FilterRule      `yaml:"filters,omitempty"`   // Drop or keep rules applied before batching
+	Redact    RedactConfig      `yaml:"redact,omitempty"`    // Sensitive data to remove before events are shipped
+	Limits    LimitsConfig      `yaml:"limits,omitempty"`    // Rate limits and sampling
+	// Compression of ingest payloads: none (default) or gzip
+	Compression string      `yaml:"compression,omitempty"`
+	Batch       BatchConfig `yaml:"batch,omitempty"` // Batch size and linger limits
+	TLS         TLSConfig   `yaml:"tls,omitempty"`   // Ingest TLS settings, merged over the global http.tls
 }
 
 // GetURL returns the full ingest URL for this stream
@@ -48,12 +94,20 @@ func (sc StreamConfig) GetURL() string {
 	return fmt.Sprintf("https://app.tailstream.io/api/ingest/%s", sc.StreamID)
 }
 
-// loadConfig resolves configuration from environment, flags and optional YAML file.
-func loadConfig() Config {
+// configPath is the file loadConfig read; run reloads it when it changes.
+// It is empty in tests.
+var configPath string
+
+// envOverride is the --env flag, which applies to reloaded configs as well.
+var envOverride string
+
+// defaultConfig returns the settings used where the config file is silent.
+func defaultConfig() Config {
 	var cfg Config
 
 	// Set defaults
 	cfg.Env = getenv("TAILSTREAM_ENV", "production")
+	cfg.ShutdownTimeout = 10 * time.Second
 	cfg.Discovery.Enabled = true
 	cfg.Discovery.Paths.Include = []string{
 		"/var/log/nginx/*.log",
@@ -62,12 +116,26 @@ func loadConfig() Config {
 		"/var/log/httpd/*.log",
 	}
 	cfg.Discovery.Paths.Exclude = []string{"**/*.gz", "**/*.1"}
+	cfg.Discovery.RescanInterval = defaultRescanInterval
+	cfg.Discovery.RetireAfter = defaultRetireAfter
 
 	// Update defaults
 	cfg.Updates.Enabled = true
 	cfg.Updates.Channel = "stable"
 	cfg.Updates.CheckHours = 1
 
+	// Spool defaults
+	cfg.Spool.Enabled = true
+	cfg.Spool.MaxMB = 100
+	cfg.Spool.Policy = spoolPolicyDropOldest
+
+	return cfg
+}
+
+// loadConfig resolves configuration from environment, flags and optional YAML file.
+func loadConfig() Config {
+	cfg := defaultConfig()
+
 	// Parse flags only if not already parsed (to avoid redefinition in tests)
 	if !flag.Parsed() {
 		configFile := flag.String("config", getDefaultConfigPath(), "path to YAML config")
@@ -78,14 +146,13 @@ func loadConfig() Config {
 		flag.Parse()
 
 		// Load config file (default or specified)
+		configPath = *configFile
 		if b, err := os.ReadFile(*configFile); err == nil {
 			yaml.Unmarshal(b, &cfg)
 		}
 
 		// Apply flag overrides
-		if *envFlag != "" {
-			cfg.Env = *envFlag
-		}
+		envOverride = *envFlag
 		if *debug {
 			os.Setenv("DEBUG", "1")
 		}
@@ -106,6 +173,62 @@ func loadConfig() Config {
 		}
 	}
 
+	applyOverrides(&cfg)
+	uniqueStreamNames(&cfg)
+	return cfg
+}
+
+// readConfig reads the config file at path the way loadConfig does, except
+// that a file which cannot be read or parsed is an error rather than ignored.
+func readConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	applyOverrides(&cfg)
+	uniqueStreamNames(&cfg)
+	return cfg, nil
+}
+
+// uniqueStreamNames renames streams that share a name with an earlier one,
+// since pipelines, checkpoints and tailers are told apart by name. The
+// second "app" becomes "app#2", the third "app#3", so each keeps its
+// checkpoints as long as the streams stay in the same order.
+func uniqueStreamNames(cfg *Config) {
+	seen := make(map[string]int, len(cfg.Streams))
+	for _, stream := range cfg.Streams {
+		seen[stream.Name] = 0
+	}
+	for i := range cfg.Streams {
+		name := cfg.Streams[i].Name
+		seen[name]++
+		if seen[name] == 1 {
+			continue
+		}
+		var unique string
+		for n := seen[name]; ; n++ {
+			unique = fmt.Sprintf("%s#%d", name, n)
+			if _, taken := seen[unique]; !taken {
+				break
+			}
+		}
+		log.Printf("WARNING: More than one stream is named '%s' - shipping this one as '%s'; give each stream its own name", name, unique)
+		cfg.Streams[i].Name = unique
+		seen[unique] = 1
+	}
+}
+
+// applyOverrides applies the --env flag and environment variables on top
+// of the config file.
+func applyOverrides(cfg *Config) {
+	if envOverride != "" {
+		cfg.Env = envOverride
+	}
+
 	// Environment variable overrides (always apply)
 	if envKey := os.Getenv("TAILSTREAM_KEY"); envKey != "" {
 		// Legacy support: if TAILSTREAM_KEY is set and no streams have keys, apply to all streams
@@ -115,8 +238,6 @@ func loadConfig() Config {
 			}
 		}
 	}
-
-	return cfg
 }
 
 func getenv(k, def string) string {
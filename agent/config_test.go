@@ -176,3 +176,15 @@ func TestGetenv(t *testing.T) {
 		})
 	}
 }
+
+func TestUniqueStreamNames(t *testing.T) {
+	cfg := Config{Streams: []StreamConfig{{Name: "app"}, {Name: ""}, {Name: "app"}, {Name: "app#2"}, {Name: ""}, {Name: "app"}}}
+	uniqueStreamNames(&cfg)
+
+	want := []string{"app", "", "app#3", "app#2", "#2", "app#4"}
+	for i, stream := range cfg.Streams {
+		if stream.Name != want[i] {
+			t.Errorf("stream %d: name = %q, want %q", i, stream.Name, want[i])
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
 	"github.com/bmatcuk/doublestar/v4"
 )
 
@@ -8,43 +13,215 @@ import (
 type StreamFileMapping struct {
 	Stream StreamConfig
 	Files  []string
+	// Labels holds the values of the named captures in the stream path that
+	// matched each file, keyed by file; files without captures are absent
+	Labels map[string]map[string]string
+}
+
+// Exclusion records a file that matched an include pattern but was dropped
+// by an exclude pattern.
+type Exclusion struct {
+	File string
+	Rule string // the exclude pattern that matched
+	// Stream is the stream whose exclude list holds Rule; empty for
+	// discovery.paths.exclude
+	Stream string
+}
+
+// discoveryResult is the outcome of matching every configured pattern.
+type discoveryResult struct {
+	Mappings []StreamFileMapping
+	Excluded []Exclusion
+	// Unclaimed holds files matched by discovery.paths.include that no
+	// stream claims and that have no default stream to go to
+	Unclaimed []string
 }
 
 // discover finds log files and maps them to appropriate streams
 func discover(cfg Config) ([]StreamFileMapping, error) {
-	var mappings []StreamFileMapping
+	res, err := discoverFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return res.Mappings, nil
+}
+
+// discoverFiles matches each stream's paths, then routes files found by the
+// discovery include patterns that no stream claims to discovery.default_stream.
+// A file matched by a stream's paths counts as claimed even if that stream
+// excludes it.
+func discoverFiles(cfg Config) (discoveryResult, error) {
+	var res discoveryResult
+	claimed := make(map[string]bool)
 
 	for _, stream := range cfg.Streams {
 		var files []string
-		for _, pattern := range stream.Paths {
-			matches, err := doublestar.FilepathGlob(pattern)
+		labels := make(map[string]map[string]string)
+		seen := make(map[string]bool)
+		for _, path := range stream.Paths {
+			pattern, err := compilePathPattern(path)
+			if err != nil {
+				continue
+			}
+			matches, err := doublestar.FilepathGlob(pattern.glob)
 			if err != nil {
 				continue
 			}
 			for _, m := range matches {
-				if excluded(m, stream.Exclude) {
+				if seen[m] {
+					continue
+				}
+				seen[m] = true
+				// A file a stream excludes on purpose is not handed to the
+				// default stream either
+				claimed[m] = true
+				if rule, ok := excludedBy(m, stream.Exclude); ok {
+					res.Excluded = append(res.Excluded, Exclusion{File: m, Rule: rule, Stream: stream.Name})
 					continue
 				}
 				files = append(files, m)
+				if l := pattern.captures(m); l != nil {
+					labels[m] = l
+				}
 			}
 		}
 		if len(files) > 0 {
-			mappings = append(mappings, StreamFileMapping{
+			res.Mappings = append(res.Mappings, StreamFileMapping{
 				Stream: stream,
 				Files:  files,
+				Labels: labels,
 			})
 		}
 	}
 
-	return mappings, nil
+	if !cfg.Discovery.Enabled {
+		return res, nil
+	}
+
+	var unclaimed []string
+	seen := make(map[string]bool)
+	for _, pattern := range cfg.Discovery.Paths.Include {
+		matches, err := doublestar.FilepathGlob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			if seen[m] || claimed[m] {
+				continue
+			}
+			seen[m] = true
+			if rule, ok := excludedBy(m, cfg.Discovery.Paths.Exclude); ok {
+				res.Excluded = append(res.Excluded, Exclusion{File: m, Rule: rule})
+				continue
+			}
+			unclaimed = append(unclaimed, m)
+		}
+	}
+	if len(unclaimed) == 0 {
+		return res, nil
+	}
+
+	stream, ok := defaultStream(cfg)
+	if !ok {
+		res.Unclaimed = unclaimed
+		return res, nil
+	}
+	for i := range res.Mappings {
+		if res.Mappings[i].Stream.Name == stream.Name {
+			res.Mappings[i].Files = append(res.Mappings[i].Files, unclaimed...)
+			return res, nil
+		}
+	}
+	res.Mappings = append(res.Mappings, StreamFileMapping{Stream: stream, Files: unclaimed})
+	return res, nil
+}
+
+// defaultStream returns the stream named by discovery.default_stream.
+func defaultStream(cfg Config) (StreamConfig, bool) {
+	if cfg.Discovery.DefaultStream == "" {
+		return StreamConfig{}, false
+	}
+	for _, stream := range cfg.Streams {
+		if stream.Name == cfg.Discovery.DefaultStream {
+			return stream, true
+		}
+	}
+	return StreamConfig{}, false
 }
 
 func excluded(path string, patterns []string) bool {
+	_, ok := excludedBy(path, patterns)
+	return ok
+}
+
+// excludedBy returns the first pattern in patterns that matches path.
+func excludedBy(path string, patterns []string) (string, bool) {
 	for _, p := range patterns {
 		ok, err := doublestar.Match(p, path)
 		if err == nil && ok {
-			return true
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// printDiscovery writes which file goes to which stream and why the
+// remaining matches are not shipped.
+func printDiscovery(w io.Writer, cfg Config) error {
+	res, err := discoverFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(res.Mappings) == 0 {
+		fmt.Fprintf(w, "No files matched\n")
+	}
+	for _, mapping := range res.Mappings {
+		fmt.Fprintf(w, "Stream '%s':\n", mapping.Stream.Name)
+		for _, f := range mapping.Files {
+			if l := mapping.Labels[f]; len(l) > 0 {
+				fmt.Fprintf(w, "  %s %s\n", f, formatLabels(l))
+			} else {
+				fmt.Fprintf(w, "  %s\n", f)
+			}
+		}
+	}
+
+	if len(res.Excluded) > 0 {
+		fmt.Fprintf(w, "\nExcluded:\n")
+		for _, e := range res.Excluded {
+			if e.Stream != "" {
+				fmt.Fprintf(w, "  %s (stream '%s' exclude %q)\n", e.File, e.Stream, e.Rule)
+			} else {
+				fmt.Fprintf(w, "  %s (discovery.paths.exclude %q)\n", e.File, e.Rule)
+			}
+		}
+	}
+
+	if len(res.Unclaimed) > 0 {
+		fmt.Fprintf(w, "\nNot shipped (matched by discovery.paths.include, but no stream claims them):\n")
+		for _, f := range res.Unclaimed {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+		if name := cfg.Discovery.DefaultStream; name != "" {
+			fmt.Fprintf(w, "discovery.default_stream '%s' does not match any configured stream\n", name)
+		} else {
+			fmt.Fprintf(w, "Set discovery.default_stream to ship them\n")
 		}
 	}
-	return false
-}
\ No newline at end of file
+	return nil
+}
+
+// formatLabels renders labels as {k=v, ...} sorted by name.
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + "=" + labels[k]
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
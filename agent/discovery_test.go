@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func touchFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func discoveryTestConfig(dir string) Config {
+	var cfg Config
+	cfg.Discovery.Enabled = true
+	cfg.Discovery.Paths.Include = []string{filepath.Join(dir, "*")}
+	cfg.Discovery.Paths.Exclude = []string{"**/*.gz"}
+	cfg.Streams = []StreamConfig{
+		{
+			Name:    "nginx",
+			Paths:   []string{filepath.Join(dir, "access.log")},
+			Exclude: []string{"**/error.log"},
+		},
+		{Name: "catch-all"},
+	}
+	return cfg
+}
+
+func TestDiscoverRoutesUnclaimedFilesToDefaultStream(t *testing.T) {
+	dir := t.TempDir()
+	touchFiles(t, dir, "access.log", "newsite.log", "old.log.gz")
+	cfg := discoveryTestConfig(dir)
+	cfg.Discovery.DefaultStream = "catch-all"
+
+	mappings, err := discover(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, m := range mappings {
+		got[m.Stream.Name] = m.Files
+	}
+	if want := []string{filepath.Join(dir, "access.log")}; strings.Join(got["nginx"], ",") != strings.Join(want, ",") {
+		t.Errorf("nginx: expected %v, got %v", want, got["nginx"])
+	}
+	if want := []string{filepath.Join(dir, "newsite.log")}; strings.Join(got["catch-all"], ",") != strings.Join(want, ",") {
+		t.Errorf("catch-all: expected %v, got %v", want, got["catch-all"])
+	}
+}
+
+func TestDiscoverWithoutDefaultStream(t *testing.T) {
+	dir := t.TempDir()
+	touchFiles(t, dir, "access.log", "newsite.log")
+	cfg := discoveryTestConfig(dir)
+
+	res, err := discoverFiles(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Mappings) != 1 || res.Mappings[0].Stream.Name != "nginx" {
+		t.Errorf("expected only the nginx stream, got %+v", res.Mappings)
+	}
+	if len(res.Unclaimed) != 1 || res.Unclaimed[0] != filepath.Join(dir, "newsite.log") {
+		t.Errorf("expected newsite.log to be reported unclaimed, got %v", res.Unclaimed)
+	}
+
+	cfg.Discovery.Enabled = false
+	res, err = discoverFiles(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Unclaimed) != 0 {
+		t.Errorf("expected discovery patterns to be ignored when disabled, got %v", res.Unclaimed)
+	}
+}
+
+func TestDiscoverReportsExclusionRules(t *testing.T) {
+	dir := t.TempDir()
+	touchFiles(t, dir, "access.log", "error.log", "old.log.gz")
+	cfg := discoveryTestConfig(dir)
+	cfg.Streams[0].Paths = append(cfg.Streams[0].Paths, filepath.Join(dir, "error.log"))
+	cfg.Discovery.DefaultStream = "catch-all"
+
+	res, err := discoverFiles(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Exclusion{
+		filepath.Join(dir, "error.log"):  {Rule: "**/error.log", Stream: "nginx"},
+		filepath.Join(dir, "old.log.gz"): {Rule: "**/*.gz"},
+	}
+	for _, e := range res.Excluded {
+		w, ok := want[e.File]
+		if !ok || w.Rule != e.Rule || w.Stream != e.Stream {
+			t.Errorf("unexpected exclusion %+v", e)
+		}
+	}
+	if len(res.Excluded) < 2 {
+		t.Errorf("expected both exclusions to be reported, got %+v", res.Excluded)
+	}
+
+	var out bytes.Buffer
+	if err := printDiscovery(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Stream 'catch-all':") {
+		t.Errorf("a file excluded by its stream must not go to the default stream:\n%s", out.String())
+	}
+	for _, s := range []string{
+		"Stream 'nginx':",
+		"error.log (stream 'nginx' exclude \"**/error.log\")",
+		"old.log.gz (discovery.paths.exclude \"**/*.gz\")",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected output to contain %q, got:\n%s", s, out.String())
+		}
+	}
+}
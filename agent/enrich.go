@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// Headers carrying the metadata of a batch. They describe every event in the
+// request, so host and environment are sent once per batch instead of on
+// every line.
+const (
+	headerHost         = "X-Tailstream-Host"
+	headerEnv          = "X-Tailstream-Env"
+	headerAgentVersion = "X-Tailstream-Agent-Version"
+	headerOS           = "X-Tailstream-OS"
+	headerArch         = "X-Tailstream-Arch"
+	headerLabels       = "X-Tailstream-Labels"
+)
+
+// agentMetadata describes the host the agent runs on.
+type agentMetadata struct {
+	Host   string
+	Env    string
+	Labels map[string]string // global labels; stream labels are merged in per batch
+}
+
+// batchMetadata describes every event of a batch: the agent that read them
+// and the static labels of their stream. It is stored with spooled batches,
+// so a replay still says where they came from.
+type batchMetadata struct {
+	Host    string            `json:"host,omitempty"`
+	Env     string            `json:"env,omitempty"`
+	Version string            `json:"version"`
+	OS      string            `json:"os"`
+	Arch    string            `json:"arch"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// hostMetadata is set at startup and on config reload by setAgentMetadata.
+// While it is nil, requests carry no metadata headers.
+var hostMetadata atomic.Pointer[agentMetadata]
+
+// setAgentMetadata records the metadata of every batch started from now on.
+func setAgentMetadata(cfg Config) {
+	host := cfg.Hostname
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			log.Printf("WARNING: Cannot determine hostname: %v - set 'hostname' in the config", err)
+		}
+	}
+	hostMetadata.Store(&agentMetadata{Host: host, Env: cfg.Env, Labels: cfg.Labels})
+}
+
+// streamMetadata returns the metadata of a batch of stream read now, or nil
+// before setAgentMetadata was called. Stream labels override global labels
+// with the same name.
+func streamMetadata(stream StreamConfig) *batchMetadata {
+	m := hostMetadata.Load()
+	if m == nil {
+		return nil
+	}
+	labels := maps.Clone(m.Labels)
+	if len(stream.Labels) > 0 {
+		if labels == nil {
+			labels = make(map[string]string, len(stream.Labels))
+		}
+		maps.Copy(labels, stream.Labels)
+	}
+	return &batchMetadata{
+		Host:    m.Host,
+		Env:     m.Env,
+		Version: Version,
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Labels:  labels,
+	}
+}
+
+// setMetadataHeaders adds the metadata of a batch to req. A nil meta adds
+// nothing.
+func setMetadataHeaders(req *http.Request, meta *batchMetadata) {
+	if meta == nil {
+		return
+	}
+	if meta.Host != "" {
+		req.Header.Set(headerHost, meta.Host)
+	}
+	if meta.Env != "" {
+		req.Header.Set(headerEnv, meta.Env)
+	}
+	req.Header.Set(headerAgentVersion, meta.Version)
+	req.Header.Set(headerOS, meta.OS)
+	req.Header.Set(headerArch, meta.Arch)
+
+	if len(meta.Labels) > 0 {
+		labels := url.Values{}
+		for k, v := range meta.Labels {
+			labels.Set(k, v)
+		}
+		// Query encoding keeps any character in names and values unambiguous
+		req.Header.Set(headerLabels, labels.Encode())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPostPayloadSendsMetadataHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{
+		Env:      "production",
+		Hostname: "web-1",
+		Labels:   map[string]string{"team": "core", "region": "eu-west"},
+	})
+
+	stream := StreamConfig{
+		Name:     "app",
+		StreamID: "test",
+		URL:      srv.URL,
+		Labels:   map[string]string{"region": "us-east", "service": "api & web"},
+	}
+	if err := postPayload(context.Background(), stream, "token", []byte("{}\n"), streamMetadata(stream)); err != nil {
+		t.Fatalf("postPayload failed: %v", err)
+	}
+
+	for header, want := range map[string]string{
+		headerHost:         "web-1",
+		headerEnv:          "production",
+		headerAgentVersion: Version,
+		headerOS:           runtime.GOOS,
+		headerArch:         runtime.GOARCH,
+	} {
+		if got.Get(header) != want {
+			t.Errorf("%s = %q, want %q", header, got.Get(header), want)
+		}
+	}
+	expectLabelsHeader(t, got, map[string]string{"team": "core", "region": "us-east", "service": "api & web"})
+}
+
+func expectLabelsHeader(t *testing.T, h http.Header, want map[string]string) {
+	t.Helper()
+	labels, err := url.ParseQuery(h.Get(headerLabels))
+	if err != nil {
+		t.Fatalf("labels header is not query encoded: %v", err)
+	}
+	if len(labels) != len(want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+	for k, v := range want {
+		if labels.Get(k) != v {
+			t.Errorf("label %s = %q, want %q", k, labels.Get(k), v)
+		}
+	}
+}
+
+func TestMetadataDefaultsToSystemHostname(t *testing.T) {
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	setMetadataHeaders(req, streamMetadata(StreamConfig{}))
+
+	if h, err := os.Hostname(); err == nil && req.Header.Get(headerHost) != h {
+		t.Errorf("host = %q, want %q", req.Header.Get(headerHost), h)
+	}
+	if req.Header.Get(headerEnv) != "" || req.Header.Get(headerLabels) != "" {
+		t.Errorf("expected no env or labels headers, got %v", req.Header)
+	}
+}
+
+// TestEventsCarryOnlyPathLabels checks that the batch metadata is not
+// repeated on every line: events keep only what differs between them.
+func TestEventsCarryOnlyPathLabels(t *testing.T) {
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{Env: "production", Hostname: "web-1", Labels: map[string]string{"team": "core"}})
+
+	stream := StreamConfig{Name: "app", Labels: map[string]string{"service": "api"}}
+	ll := LogLine{File: "/var/log/shop/app.log", Line: `{"msg":"started"}`, Labels: map[string]string{"site": "shop"}}
+	for _, format := range []string{"", formatJSON} {
+		stream.Format = format
+		ev, _ := newLineParser(stream).parse(ll)
+		data, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, repeated := range []string{"web-1", "production", "core", "api", Version} {
+			if strings.Contains(string(data), repeated) {
+				t.Errorf("format %q: batch metadata %q repeated on the event: %s", format, repeated, data)
+			}
+		}
+		if !strings.Contains(string(data), `"labels":{"site":"shop"}`) {
+			t.Errorf("format %q: expected the path labels on the event, got %s", format, data)
+		}
+	}
+}
+
+// TestSpooledBatchesKeepTheirMetadata checks that a batch replayed after a
+// config change still describes where it came from.
+func TestSpooledBatchesKeepTheirMetadata(t *testing.T) {
+	var healthy atomic.Bool
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		headers <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{Hostname: "web-1", Env: "staging"})
+
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: srv.URL, Labels: map[string]string{"service": "api"},
+		Retry: RetryConfig{InitialInterval: 10 * time.Millisecond, MaxElapsed: 20 * time.Millisecond}}
+	s, err := openSpool("app", t.TempDir(), SpoolConfig{Enabled: true, MaxMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := deliver(context.Background(), stream, s, []Event{"one"}, streamMetadata(stream)); err != nil {
+		t.Fatalf("deliver during outage should spool, got %v", err)
+	}
+
+	setAgentMetadata(Config{Hostname: "web-2", Env: "production"})
+	stream.Labels = map[string]string{"service": "web"}
+	healthy.Store(true)
+	if err := s.drain(context.Background(), stream); err != nil {
+		t.Fatal(err)
+	}
+	h := <-headers
+	if h.Get(headerHost) != "web-1" || h.Get(headerEnv) != "staging" {
+		t.Errorf("expected the metadata of when the batch was read, got host=%q env=%q", h.Get(headerHost), h.Get(headerEnv))
+	}
+	expectLabelsHeader(t, h, map[string]string{"service": "api"})
+}
+
+// TestSummaryEventsCarryMetadata checks that the loss summaries the agent
+// ships itself say which host shed the lines, like every other event.
+func TestSummaryEventsCarryMetadata(t *testing.T) {
+	summaries := make(chan http.Header, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(b), `"summary"`) {
+			summaries <- r.Header.Clone()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{Hostname: "web-7", Env: "production"})
+
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: srv.URL,
+		Limits: LimitsConfig{RateLimit: RateLimitConfig{Stream: TokenBucket{Rate: 1, Burst: 1}}}}
+	p := newPipeline(stream, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(context.Background(), make(chan struct{}))
+	}()
+	for i := 0; i < 5; i++ {
+		p.lines <- LogLine{File: "/app.log", Line: "line"}
+	}
+	// The final summary goes out on shutdown
+	close(p.lines)
+	<-done
+
+	select {
+	case h := <-summaries:
+		if h.Get(headerHost) != "web-7" || h.Get(headerEnv) != "production" || h.Get(headerAgentVersion) != Version {
+			t.Errorf("summary shipped without the agent's metadata: %v", h)
+		}
+	default:
+		t.Fatal("no summary was shipped")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of a FilterRule.
+const (
+	filterDrop = "drop"
+	filterKeep = "keep"
+)
+
+// filterReportInterval is how often each stream logs what its filters dropped.
+const filterReportInterval = time.Minute
+
+// FilterRule drops or keeps the events it matches. A rule matches when every
+// condition it sets holds: Pattern on the raw line, and Equals, Matches, Min
+// and Max on the parsed Field.
+type FilterRule struct {
+	Name    string   `yaml:"name,omitempty"`    // Shown in the drop counters (default: "rule N")
+	Action  string   `yaml:"action"`            // drop or keep
+	Pattern string   `yaml:"pattern,omitempty"` // Regexp on the raw line
+	Field   string   `yaml:"field,omitempty"`   // Parsed field such as status or path; dots reach into JSON objects
+	Equals  string   `yaml:"equals,omitempty"`  // Field value equals this
+	Matches string   `yaml:"matches,omitempty"` // Field value matches this regexp
+	Min     *float64 `yaml:"min,omitempty"`     // Field value is a number of at least this
+	Max     *float64 `yaml:"max,omitempty"`     // Field value is a number of at most this
+}
+
+type filterRule struct {
+	name    string
+	drop    bool
+	pattern *regexp.Regexp
+	field   []string
+	equals  *string
+	matches *regexp.Regexp
+	min     *float64
+	max     *float64
+
+	dropped  uint64
+	reported uint64 // dropped at the last report
+}
+
+// lineFilter applies a stream's filter rules in order; the first rule that
+// matches an event decides and events no rule matches are shipped. Keep
+// rules thus make exceptions to the drop rules after them, and a final
+// drop rule matching everything ships only what earlier keep rules match.
+// Only the stream's batching goroutine uses it.
+type lineFilter struct {
+	stream string
+	rules  []*filterRule
+}
+
+// newLineFilter returns nil when the stream has no rules. Any invalid rule
+// is an error: skipping it could turn a drop rule meant to have exceptions
+// into one that drops everything.
+func newLineFilter(stream StreamConfig) (*lineFilter, error) {
+	if len(stream.Filters) == 0 {
+		return nil, nil
+	}
+	f := &lineFilter{stream: stream.Name}
+	for i, rule := range stream.Filters {
+		r, err := newFilterRule(rule, i, stream.Format)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+func newFilterRule(rule FilterRule, i int, format string) (*filterRule, error) {
+	r := &filterRule{name: rule.Name, min: rule.Min, max: rule.Max}
+	if r.name == "" {
+		r.name = fmt.Sprintf("rule %d", i+1)
+	}
+
+	switch rule.Action {
+	case filterDrop:
+		r.drop = true
+	case filterKeep:
+	default:
+		return nil, fmt.Errorf("action must be %s or %s, got %q", filterDrop, filterKeep, rule.Action)
+	}
+
+	if rule.Pattern != "" {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.pattern = re
+	}
+
+	predicates := rule.Equals != "" || rule.Matches != "" || rule.Min != nil || rule.Max != nil
+	switch {
+	case rule.Field == "" && predicates:
+		return nil, fmt.Errorf("equals, matches, min and max need a field")
+	case rule.Field != "" && !predicates:
+		return nil, fmt.Errorf("field %s needs equals, matches, min or max", rule.Field)
+	case rule.Field != "" && (format == "" || format == formatRaw):
+		return nil, fmt.Errorf("field rules need the stream to declare a format")
+	case rule.Field == "" && r.pattern == nil:
+		return nil, fmt.Errorf("set a pattern or a field")
+	}
+	if rule.Field != "" {
+		r.field = strings.Split(rule.Field, ".")
+	}
+	if rule.Equals != "" {
+		r.equals = &rule.Equals
+	}
+	if rule.Matches != "" {
+		re, err := regexp.Compile(rule.Matches)
+		if err != nil {
+			return nil, err
+		}
+		r.matches = re
+	}
+	return r, nil
+}
+
+// allow reports whether the event parsed from ll is shipped, counting it
+// against the rule that dropped it otherwise.
+func (f *lineFilter) allow(ll LogLine, ev Event) bool {
+	for _, r := range f.rules {
+		if !r.match(ll.Line, ev) {
+			continue
+		}
+		if r.drop {
+			r.dropped++
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+func (r *filterRule) match(line string, ev Event) bool {
+	if r.pattern != nil && !r.pattern.MatchString(line) {
+		return false
+	}
+	if r.field == nil {
+		return true
+	}
+
+	v, ok := eventField(ev, r.field)
+	if !ok {
+		return false
+	}
+	if r.equals != nil && v != *r.equals {
+		return false
+	}
+	if r.matches != nil && !r.matches.MatchString(v) {
+		return false
+	}
+	if r.min != nil || r.max != nil {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || (r.min != nil && n < *r.min) || (r.max != nil && n > *r.max) {
+			return false
+		}
+	}
+	return true
+}
+
+// eventField returns a parsed field of ev as text.
+func eventField(ev Event, path []string) (string, bool) {
+	switch e := ev.(type) {
+	case LogEvent:
+		if e.Fields == nil || len(path) != 1 {
+			return "", false
+		}
+		return e.Fields.field(path[0])
+	case JSONEvent:
+		raw, ok := lookupField(e.Object, path)
+		if !ok {
+			return "", false
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s, true
+		}
+		// Numbers, booleans and null as written; objects and arrays verbatim
+		return string(raw), true
+	}
+	return "", false
+}
+
+// field returns the value of the field with the given JSON name.
+func (f *AccessFields) field(name string) (string, bool) {
+	switch name {
+	case "remote_addr":
+		return f.RemoteAddr, true
+	case "timestamp":
+		if f.Timestamp == nil {
+			return "", false
+		}
+		return f.Timestamp.Format(time.RFC3339Nano), true
+	case "method":
+		return f.Method, true
+	case "path":
+		return f.Path, true
+	case "protocol":
+		return f.Protocol, true
+	case "status":
+		return strconv.Itoa(f.Status), true
+	case "bytes":
+		return strconv.FormatInt(f.Bytes, 10), true
+	case "referer":
+		return f.Referer, true
+	case "user_agent":
+		return f.UserAgent, true
+	case "request_time":
+		return strconv.FormatFloat(f.RequestTime, 'f', -1, 64), true
+	case "upstream_time":
+		return strconv.FormatFloat(f.UpstreamTime, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// report logs how many events each rule dropped since the last report, if
+// any were. With total set it logs the counts since startup instead.
+func (f *lineFilter) report(total bool) {
+	var parts []string
+	var sum uint64
+	for _, r := range f.rules {
+		count := r.dropped
+		if !total {
+			count -= r.reported
+		}
+		r.reported = r.dropped
+		if count > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", r.name, count))
+			sum += count
+		}
+	}
+	if sum == 0 {
+		return
+	}
+	if total {
+		log.Printf("FILTER: Stream '%s' dropped %d events in total: %s", f.stream, sum, strings.Join(parts, ", "))
+	} else {
+		log.Printf("FILTER: Stream '%s' dropped %d events in the last %v: %s", f.stream, sum, filterReportInterval, strings.Join(parts, ", "))
+	}
+}
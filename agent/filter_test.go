@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestLineFilter(t *testing.T) {
+	stream := StreamConfig{
+		Name:   "nginx",
+		Format: formatCombined,
+		Filters: []FilterRule{
+			{Name: "health-checks", Action: filterDrop, Field: "path", Matches: `^/(healthz|ping)`},
+			{Name: "errors", Action: filterKeep, Field: "status", Min: floatPtr(500)},
+			{Name: "assets", Action: filterDrop, Pattern: `\.(css|js|png) HTTP`},
+		},
+	}
+	f, err := newLineFilter(stream)
+	if err != nil || f == nil || len(f.rules) != 3 {
+		t.Fatalf("expected 3 rules, got %+v", f)
+	}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`10.0.0.1 - - [22/Sep/2025:17:04:36 +0000] "GET /healthz HTTP/1.1" 200 2 "-" "kube-probe"`, false},
+		{`10.0.0.1 - - [22/Sep/2025:17:04:36 +0000] "GET /ping HTTP/1.1" 503 2 "-" "kube-probe"`, false},
+		{`10.0.0.1 - - [22/Sep/2025:17:04:36 +0000] "GET /app.js HTTP/1.1" 502 0 "-" "curl"`, true},
+		{`10.0.0.1 - - [22/Sep/2025:17:04:36 +0000] "GET /app.js HTTP/1.1" 200 512 "-" "curl"`, false},
+		{`10.0.0.1 - - [22/Sep/2025:17:04:36 +0000] "GET /orders HTTP/1.1" 200 512 "-" "curl"`, true},
+		{"not an access log line", true},
+	}
+	for _, tt := range tests {
+		ll := LogLine{File: "/var/log/nginx/access.log", Line: tt.line}
+		ev, _ := parseLineFormat(ll, stream.Format)
+		if got := f.allow(ll, ev); got != tt.want {
+			t.Errorf("allow(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+
+	if f.rules[0].dropped != 2 || f.rules[2].dropped != 1 {
+		t.Errorf("unexpected counters: health-checks=%d assets=%d", f.rules[0].dropped, f.rules[2].dropped)
+	}
+}
+
+func TestLineFilterKeepOnly(t *testing.T) {
+	f, _ := newLineFilter(StreamConfig{
+		Name:   "app",
+		Format: formatJSON,
+		Filters: []FilterRule{
+			{Action: filterKeep, Field: "level", Equals: "error"},
+			{Name: "everything else", Action: filterDrop, Pattern: ".*"},
+		},
+	})
+
+	for line, want := range map[string]bool{
+		`{"level":"error","msg":"boom"}`: true,
+		`{"level":"debug","msg":"tick"}`: false,
+		`{"msg":"no level"}`:             false,
+		"plain text":                     false,
+	} {
+		ll := LogLine{File: "/app.log", Line: line}
+		ev, _ := parseLineFormat(ll, formatJSON)
+		if got := f.allow(ll, ev); got != want {
+			t.Errorf("allow(%q) = %v, want %v", line, got, want)
+		}
+	}
+	if f.rules[1].dropped != 3 {
+		t.Errorf("expected 3 events dropped by the catch-all rule, got %d", f.rules[1].dropped)
+	}
+}
+
+func TestLineFilterNestedJSONField(t *testing.T) {
+	f, _ := newLineFilter(StreamConfig{
+		Name:    "app",
+		Format:  formatJSON,
+		Filters: []FilterRule{{Action: filterDrop, Field: "http.status", Max: floatPtr(399)}},
+	})
+	for line, want := range map[string]bool{
+		`{"http":{"status":200}}`: false,
+		`{"http":{"status":404}}`: true,
+		`{"http":{}}`:             true,
+	} {
+		ll := LogLine{File: "/app.log", Line: line}
+		ev, _ := parseLineFormat(ll, formatJSON)
+		if got := f.allow(ll, ev); got != want {
+			t.Errorf("allow(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestInvalidFilterRulesAreRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		rule   FilterRule
+	}{
+		{"unknown action", formatCombined, FilterRule{Action: "discard", Pattern: "x"}},
+		{"no condition", formatCombined, FilterRule{Action: filterDrop}},
+		{"field without predicate", formatCombined, FilterRule{Action: filterDrop, Field: "status"}},
+		{"predicate without field", formatCombined, FilterRule{Action: filterDrop, Equals: "200"}},
+		{"field on raw stream", "", FilterRule{Action: filterDrop, Field: "status", Equals: "200"}},
+		{"invalid regexp", formatCombined, FilterRule{Action: filterDrop, Pattern: "("}},
+	}
+	for _, tt := range tests {
+		if _, err := newLineFilter(StreamConfig{Name: "s", Format: tt.format, Filters: []FilterRule{tt.rule}}); err == nil {
+			t.Errorf("%s: expected the rule to be rejected", tt.name)
+		}
+	}
+
+	// A broken exception must not leave the catch-all drop after it in place
+	_, err := newLineFilter(StreamConfig{Name: "s", Filters: []FilterRule{
+		{Action: filterKeep, Pattern: "("},
+		{Action: filterDrop, Pattern: ".*"},
+	}})
+	if err == nil {
+		t.Error("expected a filter with an invalid keep rule to be rejected")
+	}
+}
+
+func TestPipelineDropsFilteredLines(t *testing.T) {
+	p := newPipeline(StreamConfig{
+		Name:    "app",
+		Filters: []FilterRule{{Action: filterDrop, Pattern: "DEBUG"}},
+	}, nil, nil)
+
+	in := make(chan LogLine, 3)
+	out := make(chan pendingBatch, 1)
+	in <- LogLine{File: "/app.log", Line: "DEBUG noisy", Pos: FilePosition{Offset: 12}}
+	in <- LogLine{File: "/app.log", Line: "INFO started", Pos: FilePosition{Offset: 25}}
+	in <- LogLine{File: "/app.log", Line: "DEBUG noisy", Pos: FilePosition{Offset: 37}}
+	close(in)
+	p.batch(in, out)
+
+	b := <-out
+	if len(b.events) != 1 || b.events[0].(LogEvent).Log != "INFO started" {
+		t.Fatalf("expected only the INFO line, got %+v", b.events)
+	}
+	// Dropped lines still advance the checkpoint
+	if b.positions["/app.log"].Offset != 37 {
+		t.Errorf("expected the checkpoint past the last dropped line, got %+v", b.positions["/app.log"])
+	}
+}
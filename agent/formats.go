@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log formats a stream can declare with `format:`. Without one, lines are
+// shipped raw and the backend parses them.
+const (
+	formatRaw      = "raw"
+	formatCombined = "combined" // nginx and apache default access log
+	formatCommon   = "common"   // Common Log Format
+	formatCaddy    = "caddy"    // Caddy JSON access log
+	formatJSON     = "json"     // JSON object lines, shipped as objects
+)
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+var (
+	// remote_addr ident user [time] "request" status bytes
+	commonPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-)\s*$`)
+	// common, then "referer" "user agent" and an optional trailing upstream
+	// response time, as in nginx's `... "$http_user_agent" $upstream_response_time`
+	combinedPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"(?:\s+(\d+(?:\.\d+)?|-))?\s*$`)
+)
+
+// AccessFields are the typed fields parsed from an access log line.
+type AccessFields struct {
+	RemoteAddr   string     `json:"remote_addr,omitempty"`
+	Timestamp    *time.Time `json:"timestamp,omitempty"`
+	Method       string     `json:"method,omitempty"`
+	Path         string     `json:"path,omitempty"`
+	Protocol     string     `json:"protocol,omitempty"`
+	Status       int        `json:"status,omitempty"`
+	Bytes        int64      `json:"bytes"`
+	Referer      string     `json:"referer,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	RequestTime  float64    `json:"request_time,omitempty"`  // seconds
+	UpstreamTime float64    `json:"upstream_time,omitempty"` // seconds
+}
+
+// validFormat reports whether format names a supported log format.
+func validFormat(format string) bool {
+	switch format {
+	case "", formatRaw, formatCombined, formatCommon, formatCaddy, formatJSON:
+		return true
+	}
+	return false
+}
+
+// parseFormat parses line according to format. It returns nil fields and no
+// error for raw streams.
+func parseFormat(format, line string) (*AccessFields, error) {
+	switch format {
+	case formatCombined:
+		return parseCLF(combinedPattern, format, line)
+	case formatCommon:
+		return parseCLF(commonPattern, format, line)
+	case formatCaddy:
+		return parseCaddy(line)
+	}
+	return nil, nil
+}
+
+func parseCLF(pattern *regexp.Regexp, format, line string) (*AccessFields, error) {
+	m := pattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("line does not match %s format", format)
+	}
+
+	f := &AccessFields{RemoteAddr: m[1]}
+	if ts, err := time.Parse(clfTimeLayout, m[2]); err == nil {
+		f.Timestamp = &ts
+	} else {
+		return nil, fmt.Errorf("invalid timestamp %q", m[2])
+	}
+	// A malformed request line (scanners, TLS on a plain port) leaves
+	// method and path empty rather than failing the whole line
+	if parts := strings.Fields(m[3]); len(parts) == 3 {
+		f.Method, f.Path, f.Protocol = parts[0], parts[1], parts[2]
+	}
+	f.Status, _ = strconv.Atoi(m[4])
+	if m[5] != "-" {
+		f.Bytes, _ = strconv.ParseInt(m[5], 10, 64)
+	}
+	if len(m) > 6 {
+		f.Referer = dashEmpty(m[6])
+		f.UserAgent = dashEmpty(m[7])
+		if m[8] != "" && m[8] != "-" {
+			f.UpstreamTime, _ = strconv.ParseFloat(m[8], 64)
+		}
+	}
+	return f, nil
+}
+
+func dashEmpty(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// caddyEntry is the subset of Caddy's JSON access log that is parsed.
+type caddyEntry struct {
+	Ts      json.RawMessage `json:"ts"`
+	Request struct {
+		RemoteIP string              `json:"remote_ip"`
+		ClientIP string              `json:"client_ip"`
+		Proto    string              `json:"proto"`
+		Method   string              `json:"method"`
+		URI      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+	} `json:"request"`
+	Duration float64 `json:"duration"`
+	Size     int64   `json:"size"`
+	Status   int     `json:"status"`
+}
+
+func parseCaddy(line string) (*AccessFields, error) {
+	var e caddyEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		return nil, fmt.Errorf("line is not caddy JSON: %v", err)
+	}
+	if e.Status == 0 || e.Request.Method == "" {
+		return nil, fmt.Errorf("line is not a caddy access log entry")
+	}
+
+	f := &AccessFields{
+		RemoteAddr:  e.Request.ClientIP,
+		Method:      e.Request.Method,
+		Path:        e.Request.URI,
+		Protocol:    e.Request.Proto,
+		Status:      e.Status,
+		Bytes:       e.Size,
+		RequestTime: e.Duration,
+	}
+	if f.RemoteAddr == "" {
+		f.RemoteAddr = e.Request.RemoteIP
+	}
+	if ua := e.Request.Headers["User-Agent"]; len(ua) > 0 {
+		f.UserAgent = ua[0]
+	}
+	if ref := e.Request.Headers["Referer"]; len(ref) > 0 {
+		f.Referer = ref[0]
+	}
+	if ts, ok := caddyTime(e.Ts); ok {
+		f.Timestamp = &ts
+	}
+	return f, nil
+}
+
+// caddyTime reads Caddy's "ts", which is Unix seconds by default and a
+// string when a time_format is configured.
+func caddyTime(raw json.RawMessage) (time.Time, bool) {
+	if ts, ok := parseEpoch(string(raw), false); ok {
+		return ts, true
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
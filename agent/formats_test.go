@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFormat(t *testing.T) {
+	clfTime := time.Date(2025, time.September, 22, 17, 4, 36, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   AccessFields
+	}{
+		{
+			name:   "combined",
+			format: formatCombined,
+			line:   `192.168.1.1 - - [22/Sep/2025:17:04:36 +0000] "GET /test?q=1 HTTP/1.1" 200 1024 "https://example.com/" "curl/7.68.0"`,
+			want: AccessFields{
+				RemoteAddr: "192.168.1.1", Timestamp: &clfTime, Method: "GET", Path: "/test?q=1", Protocol: "HTTP/1.1",
+				Status: 200, Bytes: 1024, Referer: "https://example.com/", UserAgent: "curl/7.68.0",
+			},
+		},
+		{
+			name:   "combined with upstream time",
+			format: formatCombined,
+			line:   `10.0.0.5 - alice [22/Sep/2025:17:04:36 +0000] "POST /api HTTP/2.0" 502 - "-" "Mozilla/5.0 \"quoted\"" 0.125`,
+			want: AccessFields{
+				RemoteAddr: "10.0.0.5", Timestamp: &clfTime, Method: "POST", Path: "/api", Protocol: "HTTP/2.0",
+				Status: 502, UserAgent: `Mozilla/5.0 \"quoted\"`, UpstreamTime: 0.125,
+			},
+		},
+		{
+			name:   "combined with malformed request line",
+			format: formatCombined,
+			line:   `203.0.113.9 - - [22/Sep/2025:17:04:36 +0000] "\x16\x03\x01" 400 157 "-" "-"`,
+			want:   AccessFields{RemoteAddr: "203.0.113.9", Timestamp: &clfTime, Status: 400, Bytes: 157},
+		},
+		{
+			name:   "common",
+			format: formatCommon,
+			line:   `127.0.0.1 - frank [22/Sep/2025:17:04:36 +0000] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			want: AccessFields{
+				RemoteAddr: "127.0.0.1", Timestamp: &clfTime, Method: "GET", Path: "/apache_pb.gif", Protocol: "HTTP/1.0",
+				Status: 200, Bytes: 2326,
+			},
+		},
+		{
+			name:   "caddy",
+			format: formatCaddy,
+			line:   `{"level":"info","ts":1758560676.5,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"10.0.0.1","client_ip":"198.51.100.7","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/index.html","headers":{"User-Agent":["curl/8.0"],"Referer":["https://ref.example/"]}},"bytes_read":0,"duration":0.0042,"size":512,"status":304}`,
+			want: AccessFields{
+				RemoteAddr: "198.51.100.7", Timestamp: timePtr(time.Unix(1758560676, 5e8).UTC()), Method: "GET", Path: "/index.html",
+				Protocol: "HTTP/2.0", Status: 304, Bytes: 512, Referer: "https://ref.example/", UserAgent: "curl/8.0", RequestTime: 0.0042,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFormat(tt.format, tt.line)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("fields mismatch\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestParseFormatFallsBackToRaw(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+	}{
+		{formatCombined, "2024-01-15T10:30:45Z ERROR Database connection failed"},
+		{formatCommon, `192.168.1.1 - - [not a time] "GET / HTTP/1.1" 200 1`},
+		{formatCaddy, `{"level":"info","msg":"server running"}`},
+		{formatCaddy, "not json"},
+	}
+	for _, tt := range tests {
+		ev, ok := parseLineFormat(LogLine{File: "/test.log", Line: tt.line}, tt.format)
+		if !ok {
+			t.Fatalf("%s: line was dropped", tt.format)
+		}
+		logEvent := ev.(LogEvent)
+		if logEvent.Log != tt.line || logEvent.Fields != nil {
+			t.Errorf("%s: expected the raw line without fields, got %+v", tt.format, logEvent)
+		}
+		if logEvent.ParseError == "" {
+			t.Errorf("%s: expected a parse error marker for %q", tt.format, tt.line)
+		}
+	}
+}
+
+func TestRawFormatHasNoFields(t *testing.T) {
+	for _, format := range []string{"", formatRaw} {
+		ev, _ := parseLineFormat(LogLine{File: "/test.log", Line: "anything"}, format)
+		b, _ := json.Marshal(ev)
+		if strings.Contains(string(b), "fields") || strings.Contains(string(b), "parse_error") {
+			t.Errorf("format %q: expected only log and filename, got %s", format, b)
+		}
+	}
+}
+
+func TestUnknownFormatShipsRaw(t *testing.T) {
+	if validFormat("apache-extended") {
+		t.Fatal("expected unknown format to be rejected")
+	}
+	p := newPipeline(StreamConfig{Name: "test", Format: "apache-extended"}, nil, nil)
+	if p.parser.format != "" {
+		t.Errorf("expected unknown format to fall back to raw, got %q", p.parser.format)
+	}
+}
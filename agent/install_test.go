@@ -52,7 +52,7 @@ func TestBinaryInstallation(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, bin, "run", "--config", cfgFile, "--debug")
-	cmd.Env = append(os.Environ(), "TAILSTREAM_KEY=dummy", "TAILSTREAM_DISABLE_UPDATES=1")
+	cmd.Env = append(os.Environ(), "TAILSTREAM_KEY=dummy", "TAILSTREAM_DISABLE_UPDATES=1", "TAILSTREAM_STATE_DIR="+filepath.Join(tmp, "state"))
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &out
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Sampling modes.
+const (
+	sampleRandom = "random" // keep each event with probability Rate
+	sampleHash   = "hash"   // keep events whose key hashes below Rate, so equal keys share a fate
+)
+
+const defaultSummaryInterval = time.Minute
+
+// summaryFilename marks the summary events the agent ships itself.
+const summaryFilename = "tailstream-agent"
+
+// TokenBucket allows Rate events per second on average, with bursts of up
+// to Burst events.
+type TokenBucket struct {
+	Rate  float64 `yaml:"rate"`            // Events per second; 0 disables the limit
+	Burst int     `yaml:"burst,omitempty"` // Bucket size (default: one second's worth)
+}
+
+// RateLimitConfig caps how many events a stream ships, as a whole and per file.
+type RateLimitConfig struct {
+	Stream TokenBucket `yaml:"stream,omitempty"` // Limit for all files of the stream together
+	File   TokenBucket `yaml:"file,omitempty"`   // Limit for each file on its own
+}
+
+// SamplingConfig ships a fraction of a stream's events.
+type SamplingConfig struct {
+	Rate  float64 `yaml:"rate"`            // Fraction of events to keep; 0 and 1 keep them all
+	Mode  string  `yaml:"mode,omitempty"`  // random (default) or hash
+	Field string  `yaml:"field,omitempty"` // Parsed field hashed in hash mode (default: the whole line)
+}
+
+// LimitsConfig groups the settings that shed load under pressure.
+type LimitsConfig struct {
+	RateLimit RateLimitConfig `yaml:"rate_limit,omitempty"`
+	Sampling  SamplingConfig  `yaml:"sampling,omitempty"`
+	// SummaryInterval is how often an event reporting what was shed is shipped
+	SummaryInterval time.Duration `yaml:"summary_interval,omitempty"`
+}
+
+// check reports settings that cannot be used to sample a stream with format.
+func (s SamplingConfig) check(format string) error {
+	switch {
+	case s.Rate < 0 || s.Rate > 1:
+		return fmt.Errorf("rate must be between 0 and 1, got %v", s.Rate)
+	case s.Rate == 0 || s.Rate == 1:
+		return nil
+	case s.Mode != "" && s.Mode != sampleRandom && s.Mode != sampleHash:
+		return fmt.Errorf("unknown mode '%s'", s.Mode)
+	case s.Field != "" && (format == "" || format == formatRaw):
+		return errors.New("field needs the stream to declare a format")
+	}
+	return nil
+}
+
+func (c LimitsConfig) enabled() bool {
+	return c.RateLimit.Stream.Rate > 0 || c.RateLimit.File.Rate > 0 || (c.Sampling.Rate > 0 && c.Sampling.Rate != 1)
+}
+
+// bucket is the state of a TokenBucket.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(tb TokenBucket, now time.Time) *bucket {
+	burst := float64(tb.Burst)
+	if burst <= 0 {
+		burst = math.Max(tb.Rate, 1)
+	}
+	return &bucket{rate: tb.Rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *bucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// limiter samples and rate limits the events of one stream and counts what
+// it sheds until the next summary. Only the stream's batching goroutine uses it.
+type limiter struct {
+	stream     string
+	streamRate *bucket
+	fileRate   TokenBucket
+	files      map[string]*bucket
+
+	sampleRate float64
+	sampleMode string
+	sampleKey  []string // parsed field hashed in hash mode; nil hashes the line
+
+	interval    time.Duration
+	windowStart time.Time
+	sampled     uint64
+	limited     uint64
+	limitedBy   map[string]uint64 // rate limited events per file
+}
+
+// newLimiter returns nil when the stream sheds nothing. Invalid settings are
+// logged and the affected limit is ignored.
+func newLimiter(stream StreamConfig, now time.Time) *limiter {
+	cfg := stream.Limits
+	if !cfg.enabled() {
+		return nil
+	}
+	l := &limiter{
+		stream:      stream.Name,
+		files:       make(map[string]*bucket),
+		interval:    cfg.SummaryInterval,
+		windowStart: now,
+		limitedBy:   make(map[string]uint64),
+	}
+	if l.interval <= 0 {
+		l.interval = defaultSummaryInterval
+	}
+	if cfg.RateLimit.Stream.Rate > 0 {
+		l.streamRate = newBucket(cfg.RateLimit.Stream, now)
+	}
+	if cfg.RateLimit.File.Rate > 0 {
+		l.fileRate = cfg.RateLimit.File
+	}
+
+	s := cfg.Sampling
+	err := s.check(stream.Format)
+	switch {
+	case err != nil:
+		log.Printf("ERROR: Invalid sampling for stream '%s': %v - not sampling", stream.Name, err)
+	case s.Rate == 0 || s.Rate == 1:
+		// Keeping every event is not sampling
+	default:
+		l.sampleRate = s.Rate
+		l.sampleMode = s.Mode
+		if l.sampleMode == "" {
+			l.sampleMode = sampleRandom
+		}
+		if s.Field != "" {
+			l.sampleKey = strings.Split(s.Field, ".")
+		}
+	}
+	return l
+}
+
+// allow reports whether the event parsed from ll is shipped. Sampling comes
+// first, so rate limits count only events that sampling kept.
+func (l *limiter) allow(ll LogLine, ev Event, now time.Time) bool {
+	if l.sampleRate > 0 && !l.sample(ll, ev) {
+		l.sampled++
+		return false
+	}
+	if l.fileRate.Rate > 0 {
+		b, ok := l.files[ll.File]
+		if !ok {
+			b = newBucket(l.fileRate, now)
+			l.files[ll.File] = b
+		}
+		if !b.allow(now) {
+			l.limited++
+			l.limitedBy[ll.File]++
+			return false
+		}
+	}
+	if l.streamRate != nil && !l.streamRate.allow(now) {
+		l.limited++
+		l.limitedBy[ll.File]++
+		return false
+	}
+	return true
+}
+
+func (l *limiter) sample(ll LogLine, ev Event) bool {
+	if l.sampleMode == sampleRandom {
+		return rand.Float64() < l.sampleRate
+	}
+	key := ll.Line
+	if l.sampleKey != nil {
+		if v, ok := eventField(ev, l.sampleKey); ok {
+			key = v
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < l.sampleRate
+}
+
+// SummaryEvent reports the events a stream shed in a window. It reads as a
+// log line in Tailstream, with the counts under "summary".
+type SummaryEvent struct {
+	Log        string      `json:"log"`
+	Filename   string      `json:"filename"`
+	ObservedAt time.Time   `json:"observed_at"`
+	Summary    LossSummary `json:"summary"`
+}
+
+// LossSummary counts the events shed in a window.
+type LossSummary struct {
+	Stream       string            `json:"stream"`
+	WindowStart  time.Time         `json:"window_start"`
+	WindowEnd    time.Time         `json:"window_end"`
+	SampledOut   uint64            `json:"sampled_out"`
+	SamplingRate float64           `json:"sampling_rate,omitempty"`
+	RateLimited  uint64            `json:"rate_limited"`
+	ByFile       map[string]uint64 `json:"rate_limited_by_file,omitempty"`
+}
+
+// summary returns an event reporting what was shed since the last summary
+// and starts a new window. It returns false when nothing was shed.
+func (l *limiter) summary(now time.Time) (SummaryEvent, bool) {
+	defer l.forgetIdleFiles(now)
+	if l.sampled == 0 && l.limited == 0 {
+		l.windowStart = now
+		return SummaryEvent{}, false
+	}
+
+	s := LossSummary{
+		Stream:       l.stream,
+		WindowStart:  l.windowStart.UTC(),
+		WindowEnd:    now.UTC(),
+		SampledOut:   l.sampled,
+		SamplingRate: l.sampleRate,
+		RateLimited:  l.limited,
+	}
+	if len(l.limitedBy) > 0 {
+		s.ByFile = l.limitedBy
+	}
+	ev := SummaryEvent{
+		Log: fmt.Sprintf("tailstream-agent: stream '%s' shed %d events in %v (%d sampled out, %d rate limited)",
+			l.stream, l.sampled+l.limited, now.Sub(l.windowStart).Round(time.Second), l.sampled, l.limited),
+		Filename:   summaryFilename,
+		ObservedAt: now.UTC(),
+		Summary:    s,
+	}
+
+	l.windowStart = now
+	l.sampled, l.limited = 0, 0
+	l.limitedBy = make(map[string]uint64)
+	return ev, true
+}
+
+// forgetIdleFiles drops the buckets of files that have been quiet long
+// enough to refill, so rotated and retired files do not pile up.
+func (l *limiter) forgetIdleFiles(now time.Time) {
+	for file, b := range l.files {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.files, file)
+		}
+	}
+}
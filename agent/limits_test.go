@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBucket(TokenBucket{Rate: 10, Burst: 3}, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("expected the burst to allow event %d", i+1)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("expected the empty bucket to refuse")
+	}
+	if !b.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatal("expected one token after 100ms at 10/s")
+	}
+	if b.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatal("expected only one token after 100ms")
+	}
+	if got := newBucket(TokenBucket{Rate: 0.5}, now).burst; got != 1 {
+		t.Errorf("expected a default burst of at least one event, got %v", got)
+	}
+}
+
+func TestLimiterRateLimitsPerFileAndStream(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(StreamConfig{Name: "app", Limits: LimitsConfig{
+		RateLimit: RateLimitConfig{
+			File:   TokenBucket{Rate: 1, Burst: 2},
+			Stream: TokenBucket{Rate: 1, Burst: 3},
+		},
+	}}, now)
+
+	allowed := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		for _, file := range []string{"/chatty.log", "/quiet.log"} {
+			ll := LogLine{File: file, Line: "x"}
+			if l.allow(ll, nil, now) {
+				allowed[file]++
+			}
+		}
+	}
+	// The chatty file gets its 2, the quiet file the stream's last token
+	if allowed["/chatty.log"] != 2 || allowed["/quiet.log"] != 1 {
+		t.Errorf("unexpected allowance: %v", allowed)
+	}
+	if l.limited != 7 || l.limitedBy["/chatty.log"] != 3 || l.limitedBy["/quiet.log"] != 4 {
+		t.Errorf("unexpected counters: %d %v", l.limited, l.limitedBy)
+	}
+}
+
+func TestHashSamplingIsDeterministic(t *testing.T) {
+	stream := StreamConfig{Name: "app", Format: formatJSON, Limits: LimitsConfig{
+		Sampling: SamplingConfig{Rate: 0.3, Mode: sampleHash, Field: "trace_id"},
+	}}
+	decisions := make(map[string]bool)
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		// A fresh limiter each time: the decision depends on the key alone
+		l := newLimiter(stream, time.Now())
+		trace := fmt.Sprintf("trace-%d", i%100)
+		ll := LogLine{File: "/app.log", Line: fmt.Sprintf(`{"trace_id":%q,"n":%d}`, trace, i)}
+		ev, _ := parseLineFormat(ll, formatJSON)
+		ok := l.allow(ll, ev, time.Now())
+		if prev, seen := decisions[trace]; seen && prev != ok {
+			t.Fatalf("events with %s were sampled differently", trace)
+		}
+		decisions[trace] = ok
+		if ok {
+			kept++
+		}
+	}
+	if kept < 150 || kept > 450 {
+		t.Errorf("expected about 30%% of 1000 events, kept %d", kept)
+	}
+}
+
+func TestRandomSampling(t *testing.T) {
+	l := newLimiter(StreamConfig{Name: "app", Limits: LimitsConfig{Sampling: SamplingConfig{Rate: 0.25}}}, time.Now())
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		if l.allow(LogLine{File: "/app.log", Line: "same line"}, nil, time.Now()) {
+			kept++
+		}
+	}
+	if kept < 2000 || kept > 3000 {
+		t.Errorf("expected about 2500 of 10000 events, kept %d", kept)
+	}
+	if l.sampled != uint64(10000-kept) {
+		t.Errorf("expected %d sampled out, counted %d", 10000-kept, l.sampled)
+	}
+}
+
+func TestInvalidSamplingIsIgnored(t *testing.T) {
+	for name, s := range map[string]SamplingConfig{
+		"rate above one":      {Rate: 1.5},
+		"unknown mode":        {Rate: 0.5, Mode: "reservoir"},
+		"field on raw stream": {Rate: 0.5, Mode: sampleHash, Field: "status"},
+	} {
+		l := newLimiter(StreamConfig{Name: "app", Limits: LimitsConfig{Sampling: s}}, time.Now())
+		if l.sampleRate != 0 {
+			t.Errorf("%s: expected sampling to be disabled", name)
+		}
+	}
+	if newLimiter(StreamConfig{Name: "app"}, time.Now()) != nil {
+		t.Error("expected no limiter without limits")
+	}
+	keepAll := LimitsConfig{Sampling: SamplingConfig{Rate: 1}}
+	if newLimiter(StreamConfig{Name: "app", Limits: keepAll}, time.Now()) != nil {
+		t.Error("expected no limiter when sampling keeps every event")
+	}
+	keepAll.RateLimit.Stream = TokenBucket{Rate: 100}
+	if l := newLimiter(StreamConfig{Name: "app", Limits: keepAll}, time.Now()); l.sampleRate != 0 {
+		t.Error("expected a rate of one not to sample")
+	}
+}
+
+func TestLimiterSummary(t *testing.T) {
+	start := time.Date(2025, time.September, 22, 17, 0, 0, 0, time.UTC)
+	l := newLimiter(StreamConfig{Name: "app", Limits: LimitsConfig{
+		RateLimit: RateLimitConfig{File: TokenBucket{Rate: 1, Burst: 1}},
+	}}, start)
+
+	if _, ok := l.summary(start.Add(time.Minute)); ok {
+		t.Fatal("expected no summary when nothing was shed")
+	}
+
+	now := start.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		l.allow(LogLine{File: "/chatty.log", Line: "x"}, nil, now)
+	}
+	ev, ok := l.summary(now.Add(time.Minute))
+	if !ok {
+		t.Fatal("expected a summary")
+	}
+	if ev.Filename != summaryFilename || ev.Summary.RateLimited != 3 || ev.Summary.ByFile["/chatty.log"] != 3 {
+		t.Errorf("unexpected summary: %+v", ev)
+	}
+	if !ev.Summary.WindowStart.Equal(now) || !ev.Summary.WindowEnd.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected window: %v - %v", ev.Summary.WindowStart, ev.Summary.WindowEnd)
+	}
+	if _, ok := l.summary(now.Add(2 * time.Minute)); ok {
+		t.Error("expected the counters to reset after a summary")
+	}
+	if len(l.files) != 0 {
+		t.Errorf("expected the idle file's bucket to be forgotten, have %d", len(l.files))
+	}
+}
+
+func TestPipelineShipsSummaryEvent(t *testing.T) {
+	p := newPipeline(StreamConfig{Name: "app", Limits: LimitsConfig{
+		RateLimit: RateLimitConfig{Stream: TokenBucket{Rate: 1, Burst: 2}},
+	}}, nil, nil)
+
+	in := make(chan LogLine, 5)
+	out := make(chan pendingBatch, 1)
+	for i := 0; i < 5; i++ {
+		in <- LogLine{File: "/app.log", Line: fmt.Sprintf("line %d", i)}
+	}
+	close(in)
+	p.batch(in, out)
+
+	b := <-out
+	if len(b.events) != 3 {
+		t.Fatalf("expected 2 events and a summary, got %d events", len(b.events))
+	}
+	data, _ := json.Marshal(b.events[2])
+	var got SummaryEvent
+	if err := json.Unmarshal(data, &got); err != nil || got.Summary.RateLimited != 3 || got.Log == "" {
+		t.Errorf("unexpected summary event: %s", data)
+	}
+}
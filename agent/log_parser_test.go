@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -74,3 +75,70 @@ func TestParseLineIntegration(t *testing.T) {
 		})
 	}
 }
+
+func TestParseJSONLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantJSON  bool
+		wantError bool
+	}{
+		{name: "object", line: `{"level":"info","msg":"started","port":8080}`, wantJSON: true},
+		{name: "object with surrounding space", line: `  {"msg":"hi"}  `, wantJSON: true},
+		{name: "plain text", line: "listening on :8080"},
+		{name: "array", line: `[1,2,3]`},
+		{name: "partial object", line: `{"msg":"cut off mid-wr`, wantError: true},
+		{name: "trailing garbage", line: `{"msg":"hi"} extra`, wantError: true},
+		{name: "reserved key", line: `{"msg":"hi","_tailstream":"mine"}`, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, ok := parseLineFormat(LogLine{File: "/app.log", Line: tt.line}, formatJSON)
+			if !ok {
+				t.Fatal("line was dropped")
+			}
+			if _, isJSON := ev.(JSONEvent); isJSON != tt.wantJSON {
+				t.Fatalf("expected JSON passthrough %v, got %T", tt.wantJSON, ev)
+			}
+			if tt.wantJSON {
+				return
+			}
+			logEvent := ev.(LogEvent)
+			if logEvent.Log != tt.line {
+				t.Errorf("expected the raw line to be kept, got %q", logEvent.Log)
+			}
+			if (logEvent.ParseError != "") != tt.wantError {
+				t.Errorf("expected parse error %v, got %q", tt.wantError, logEvent.ParseError)
+			}
+		})
+	}
+}
+
+func TestJSONEventEncoding(t *testing.T) {
+	line := `{"msg":"hi","count":12345678901234567890,"nested":{"a":[1,2]},"filename":"app-set"}`
+	ev, _ := parseLineFormat(LogLine{File: "/app.log", Line: line}, formatJSON)
+
+	payload := encodeNDJSON([]Event{ev})
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("payload is not a JSON object: %v\n%s", err, payload)
+	}
+
+	// Application keys are shipped untouched, including large numbers and
+	// a "filename" key of their own
+	for key, want := range map[string]string{
+		"msg":      `"hi"`,
+		"count":    `12345678901234567890`,
+		"nested":   `{"a":[1,2]}`,
+		"filename": `"app-set"`,
+	} {
+		if string(got[key]) != want {
+			t.Errorf("key %s: expected %s, got %s", key, want, got[key])
+		}
+	}
+	var meta EventMeta
+	if err := json.Unmarshal(got[metaKey], &meta); err != nil || meta.Filename != "/app.log" {
+		t.Errorf("expected agent metadata under %s, got %s", metaKey, got[metaKey])
+	}
+}
@@ -10,9 +10,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -23,125 +23,14 @@ var (
 	GitCommit = "unknown"
 )
 
-// LogLine represents a line read from a file.
-type LogLine struct {
-	File string
-	Line string
-}
-
-// tailFile streams appended lines from a file.
-// If the file becomes inaccessible, it will retry opening it every 5 seconds.
-// It also detects log rotation by tracking file inodes.
-func tailFile(ctx context.Context, file string, ch chan<- LogLine) {
-	var f *os.File
-	var reader *bufio.Reader
-	var currentInode uint64
-	var err error
-
-	// Try to open file initially
-	f, err = os.Open(file)
-	if err != nil {
-		log.Printf("ERROR: Cannot open %s: %v - will retry every 5s", file, err)
-	} else {
-		f.Seek(0, io.SeekEnd)
-		reader = bufio.NewReader(f)
-		if stat, err := f.Stat(); err == nil {
-			if sys := stat.Sys(); sys != nil {
-				if stat_t, ok := sys.(*syscall.Stat_t); ok {
-					currentInode = stat_t.Ino
-				}
-			}
-		}
-	}
-
-	retryTicker := time.NewTicker(5 * time.Second)
-	defer retryTicker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			if f != nil {
-				f.Close()
-			}
-			return
-
-		case <-retryTicker.C:
-			// Check if file has been rotated (inode changed)
-			if f != nil {
-				if stat, err := os.Stat(file); err == nil {
-					if sys := stat.Sys(); sys != nil {
-						if stat_t, ok := sys.(*syscall.Stat_t); ok {
-							if stat_t.Ino != currentInode {
-								log.Printf("ROTATION: File %s rotated (inode changed %d -> %d), reconnecting", file, currentInode, stat_t.Ino)
-								f.Close()
-								f = nil
-								reader = nil
-								currentInode = 0
-							}
-						}
-					}
-				} else {
-					// File disappeared, close and retry
-					log.Printf("ROTATION: File %s disappeared, will reconnect", file)
-					f.Close()
-					f = nil
-					reader = nil
-					currentInode = 0
-				}
-			}
-
-			// Retry opening file if we don't have it open
-			if f == nil {
-				f, err = os.Open(file)
-				if err != nil {
-					log.Printf("ERROR: Still cannot access %s: %v - will keep retrying", file, err)
-					continue
-				}
-				log.Printf("SUCCESS: Reconnected to %s after access issue/rotation", file)
-				f.Seek(0, io.SeekEnd)
-				reader = bufio.NewReader(f)
-				if stat, err := f.Stat(); err == nil {
-					if sys := stat.Sys(); sys != nil {
-						if stat_t, ok := sys.(*syscall.Stat_t); ok {
-							currentInode = stat_t.Ino
-						}
-					}
-				}
-			}
-
-		default:
-			if f == nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					time.Sleep(200 * time.Millisecond)
-					continue
-				}
-				log.Printf("ERROR: Lost access to %s: %v - will attempt to reconnect", file, err)
-				f.Close()
-				f = nil
-				reader = nil
-				currentInode = 0
-				continue
-			}
-			ch <- LogLine{File: file, Line: strings.TrimRight(line, "\r\n")}
-		}
-	}
-}
-
 // shipEvents POSTs a batch of events to a specific stream's ingest endpoint as NDJSON.
+// Failed requests are retried according to the stream's retry policy.
 func shipEvents(ctx context.Context, stream StreamConfig, globalKey string, events []Event) error {
-	if stream.StreamID == "" {
-		return fmt.Errorf("stream ID not configured for stream %s", stream.Name)
-	}
-
-	url := stream.GetURL()
+	return postWithRetry(ctx, stream, globalKey, encodeNDJSON(events), streamMetadata(stream))
+}
 
-	// Convert events to NDJSON format
+// encodeNDJSON converts events to NDJSON format.
+func encodeNDJSON(events []Event) []byte {
 	var buf bytes.Buffer
 	for _, event := range events {
 		// Marshal event to JSON (handles both strings and objects)
@@ -154,12 +43,40 @@ func shipEvents(ctx context.Context, stream StreamConfig, globalKey string, even
 		buf.Write(data)
 		buf.WriteByte('\n')
 	}
+	return buf.Bytes()
+}
+
+// postPayload POSTs an already encoded NDJSON payload to a stream's ingest endpoint,
+// compressed if the stream asks for it, with the batch's metadata as headers.
+// It makes a single attempt, plus one uncompressed if the endpoint rejects
+// the compressed payload; non-2xx responses are returned as *shipError.
+func postPayload(ctx context.Context, stream StreamConfig, globalKey string, payload []byte, meta *batchMetadata) error {
+	if stream.StreamID == "" {
+		return fmt.Errorf("stream ID not configured for stream %s", stream.Name)
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	url := stream.GetURL()
+
+	reqBody := payload
+	encoding := contentEncoding(stream, len(payload))
+	if encoding != "" {
+		compressed, err := gzipPayload(payload)
+		if err != nil {
+			return err
+		}
+		reqBody = compressed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-ndjson")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("User-Agent", ingestUserAgent())
+	setMetadataHeaders(req, meta)
 
 	// Use stream-specific key if available, otherwise fall back to global key
 	key := stream.Key
@@ -169,7 +86,10 @@ func shipEvents(ctx context.Context, stream StreamConfig, globalKey string, even
 	if key != "" {
 		req.Header.Set("Authorization", "Bearer "+key)
 	}
-	client := &http.Client{Timeout: 10 * time.Second}
+	client, err := streamClient(stream)
+	if err != nil {
+		return err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -183,14 +103,24 @@ func shipEvents(ctx context.Context, stream StreamConfig, globalKey string, even
 		log.Printf("HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
+	if resp.StatusCode == http.StatusUnsupportedMediaType && encoding != "" {
+		rejectEncoding(stream, encoding)
+		return postPayload(ctx, stream, globalKey, payload, meta)
+	}
+
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("ship: %s - %s", resp.Status, string(body))
+		se := &shipError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			se.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return se
 	}
 	return nil
 }
 
-// runStdinMode processes logs from stdin and ships them to a stream
-func runStdinMode(cfg Config) {
+// runStdinMode processes logs from stdin and ships them to a stream until
+// stdin closes or SIGTERM/SIGINT arrives, then flushes and returns an exit code.
+func runStdinMode(cfg Config) int {
 	// Get stream ID from flag or environment
 	streamID := os.Getenv("TAILSTREAM_STREAM_ID")
 	if streamID == "" {
@@ -217,7 +147,20 @@ func runStdinMode(cfg Config) {
 		accessToken = os.Getenv("TAILSTREAM_KEY")
 	}
 
+	// A configured stream with the same ID supplies per-stream settings,
+	// such as multiline rules, and is preferred for the access token
+	configured, hasConfigured := StreamConfig{}, false
+	for _, s := range cfg.Streams {
+		if s.StreamID == streamID {
+			configured, hasConfigured = s, true
+			break
+		}
+	}
+
 	// Fall back to config file
+	if accessToken == "" && configured.Key != "" {
+		accessToken = configured.Key
+	}
 	if accessToken == "" && len(cfg.Streams) > 0 && cfg.Streams[0].Key != "" {
 		accessToken = cfg.Streams[0].Key
 	}
@@ -228,33 +171,70 @@ func runStdinMode(cfg Config) {
 
 	// Create a stream config for stdin mode
 	stream := StreamConfig{
-		Name:     "stdin",
 		StreamID: streamID,
-		Key:      accessToken,
 	}
+	if hasConfigured {
+		stream = configured
+	}
+	stream.Name = "stdin"
+	stream.Key = accessToken
+	if _, err := newLineFilter(stream); err != nil {
+		log.Fatalf("Invalid filters for stream with ID %s: %v", streamID, err)
+	}
+	if _, err := newRedactor(stream.Redact); err != nil {
+		log.Fatalf("Invalid redact settings for stream with ID %s: %v", streamID, err)
+	}
+	if _, err := streamClient(stream); err != nil {
+		log.Fatalf("Invalid TLS settings for stream with ID %s: %v", streamID, err)
+	}
+
+	setAgentMetadata(cfg)
 
-	ctx := context.Background()
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	shipCtx, cancelShip := context.WithCancel(context.Background())
+	defer cancelShip()
+
+	spool := openStreamSpool(cfg, resolveStateDir(cfg), stream)
+	replayCtx, stopReplay := context.WithCancel(sigCtx)
+	defer stopReplay()
+	replayed := make(chan struct{})
+	if spool != nil {
+		defer spool.Close()
+		go func() {
+			defer close(replayed)
+			replaySpool(replayCtx, stream, spool)
+		}()
+	} else {
+		close(replayed)
+	}
+
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("Starting stdin mode for stream: %s", streamID)
+	}
+
+	// stopping is closed once stdin is exhausted or a signal arrives
+	stopping := make(chan struct{})
+	p := newPipeline(stream, spool, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(shipCtx, stopping)
+	}()
 
 	scanner := bufio.NewScanner(os.Stdin)
 	// Increase buffer size to handle large log lines (e.g., verbose JSON payloads, stack traces)
 	// Default is 64 KiB, we increase to 1 MiB
 	buf := make([]byte, 0, 64*1024)
 	scanner.Buffer(buf, 1024*1024)
-	batch := make([]Event, 0, 100)
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	if os.Getenv("DEBUG") == "1" {
-		log.Printf("Starting stdin mode for stream: %s", streamID)
-	}
 
 	// Channel for new lines
-	lines := make(chan string, 100)
+	lines := make(chan LogLine, 100)
 
 	// Read stdin in goroutine
 	go func() {
 		for scanner.Scan() {
-			lines <- scanner.Text()
+			lines <- LogLine{File: "stdin", Line: scanner.Text(), ObservedAt: time.Now()}
 		}
 		if err := scanner.Err(); err != nil {
 			log.Printf("Error reading stdin: %v", err)
@@ -262,56 +242,63 @@ func runStdinMode(cfg Config) {
 		close(lines) // Close channel instead of sending done signal
 	}()
 
-	// Process lines
+	// Feed lines into the pipeline until stdin closes or a signal arrives
 	running := true
 	for running {
 		select {
-		case <-ticker.C:
-			if len(batch) > 0 {
-				if os.Getenv("DEBUG") == "1" {
-					log.Printf("Timer tick, shipping %d events", len(batch))
-				}
-				if err := shipEvents(ctx, stream, "", batch); err != nil {
-					log.Printf("ship: %v", err)
-				}
-				batch = batch[:0]
-			}
-
-		case line, ok := <-lines:
+		case ll, ok := <-lines:
 			if !ok {
-				// Channel closed, process remaining batch and exit
 				running = false
 				break
 			}
-			if os.Getenv("DEBUG") == "1" {
-				log.Printf("Processing line: %s", line)
-			}
-			ll := LogLine{File: "stdin", Line: line}
-			ev, ok := parseLine(ll)
-			if ok && ev != nil {
-				batch = append(batch, ev)
-				if len(batch) >= 100 {
-					if os.Getenv("DEBUG") == "1" {
-						log.Printf("Batch full, shipping %d events", len(batch))
-					}
-					if err := shipEvents(ctx, stream, "", batch); err != nil {
-						log.Printf("ship: %v", err)
+			p.lines <- ll
+
+		case <-sigCtx.Done():
+			// Stop reading but keep what was already read from stdin
+			log.Printf("Shutting down: flushing pending events (timeout %v)", cfg.ShutdownTimeout)
+			for drained := false; !drained; {
+				select {
+				case ll, ok := <-lines:
+					if !ok {
+						drained = true
+						break
 					}
-					batch = batch[:0]
+					p.lines <- ll
+				default:
+					drained = true
 				}
 			}
+			running = false
 		}
 	}
 
-	// Ship any remaining events after stdin closes
-	if len(batch) > 0 {
-		if os.Getenv("DEBUG") == "1" {
-			log.Printf("EOF, shipping final %d events", len(batch))
-		}
-		if err := shipEvents(ctx, stream, "", batch); err != nil {
-			log.Printf("ship: %v", err)
+	close(stopping)
+	close(p.lines)
+	flushTimer := time.AfterFunc(cfg.ShutdownTimeout, cancelShip)
+	<-done
+	flushTimer.Stop()
+
+	code := exitOK
+	if p.failed.Load() {
+		code = exitFlushFailed
+	}
+
+	// Give spooled batches one last chance before exiting; whatever is left
+	// stays on disk and is replayed by the next run for this stream. The
+	// final drain waits for one the replayer is running, which is stopped
+	// once the shutdown timeout is up, and the replayer is stopped before
+	// returning, so no batch is sent twice.
+	if spool.Len() > 0 {
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer drainCancel()
+		context.AfterFunc(drainCtx, stopReplay)
+		if err := spool.drain(drainCtx, stream); err != nil {
+			log.Printf("SPOOL: %d batches left on disk for stream '%s': %v", spool.Len(), stream.Name, err)
 		}
 	}
+	stopReplay()
+	<-replayed
+	return code
 }
 
 func main() {
@@ -335,6 +322,7 @@ func main() {
 		fmt.Printf("  version      Show version information\n")
 		fmt.Printf("  update       Check for and install updates manually\n")
 		fmt.Printf("  status       Show agent and update status\n")
+		fmt.Printf("  discover     Show which files are shipped to which stream\n")
 		fmt.Printf("  help         Show this help message\n\n")
 		fmt.Printf("OPTIONS:\n")
 		fmt.Printf("  --config     Path to configuration file\n")
@@ -352,7 +340,8 @@ func main() {
 		fmt.Printf("  tailstream-agent run                       # Start the agent\n")
 		fmt.Printf("  tailstream-agent run --config /path/config.yaml\n")
 		fmt.Printf("  tailstream-agent update                    # Manual update check\n")
-		fmt.Printf("  tailstream-agent status                    # Check status\n\n")
+		fmt.Printf("  tailstream-agent status                    # Check status\n")
+		fmt.Printf("  tailstream-agent discover                  # Show which files go to which stream\n\n")
 		fmt.Printf("  # Stdin mode (pipe any log source):\n")
 		fmt.Printf("  # First, securely store your access token:\n")
 		fmt.Printf("  echo 'your-access-token' > ~/.tailstream-key && chmod 600 ~/.tailstream-key\n\n")
@@ -371,7 +360,13 @@ func main() {
 
 	// Handle setup command (OAuth)
 	if len(os.Args) > 1 && os.Args[1] == "setup" {
-		if err := setupOAuth(); err != nil {
+		// An existing config may hold the proxy needed to reach Tailstream
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		httpCfg := loadConfig().HTTP
+		if err := configureHTTP(httpCfg); err != nil {
+			log.Fatalf("Invalid http settings: %v", err)
+		}
+		if err := setupOAuth(httpCfg); err != nil {
 			log.Fatalf("Setup failed: %v", err)
 		}
 		return
@@ -396,9 +391,22 @@ func main() {
 		return
 	}
 
+	// Handle discover command
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		cfg := loadConfig()
+		if err := printDiscovery(os.Stdout, cfg); err != nil {
+			log.Fatalf("discover: %v", err)
+		}
+		return
+	}
+
 	// Handle update command
 	if len(os.Args) > 1 && (os.Args[1] == "update" || os.Args[1] == "--update") {
 		cfg := loadConfig()
+		if err := configureHTTP(cfg.HTTP); err != nil {
+			log.Fatalf("Invalid http settings: %v", err)
+		}
 		fmt.Printf("Checking for updates (current version: %s)...\n", Version)
 		checkForUpdatesForce(cfg, true)
 		return
@@ -434,13 +442,15 @@ func main() {
 	}
 
 	cfg := loadConfig()
+	if err := configureHTTP(cfg.HTTP); err != nil {
+		log.Fatalf("Invalid http settings: %v", err)
+	}
 
 	// Check for stdin mode
 	stat, _ := os.Stdin.Stat()
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
 		// stdin is a pipe - enter stdin mode
-		runStdinMode(cfg)
-		return
+		os.Exit(runStdinMode(cfg))
 	}
 
 	// Start background update checker
@@ -466,107 +476,82 @@ func main() {
 		log.Printf("Starting tailstream agent with %d streams (env=%s)", len(cfg.Streams), cfg.Env)
 	}
 
-	mappings, err := discover(cfg)
-	if err != nil {
-		log.Fatalf("discover: %v", err)
-	}
-	if len(mappings) == 0 {
-		log.Println("no log files discovered")
-		return
-	}
+	os.Exit(run(cfg))
+}
 
-	if os.Getenv("DEBUG") == "1" {
-		for _, mapping := range mappings {
-			log.Printf("Stream '%s': found %d files: %v", mapping.Stream.Name, len(mapping.Files), mapping.Files)
+// checkPaths reports the path patterns of stream that can never match.
+func checkPaths(stream StreamConfig) {
+	for _, path := range stream.Paths {
+		if _, err := compilePathPattern(path); err != nil {
+			log.Printf("ERROR: Stream '%s': %v - skipping this path", stream.Name, err)
 		}
 	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Exit codes returned by run. log.Fatal exits with 1 and flag parsing with
+// 2, so a failed flush has a code of its own.
+const (
+	exitOK          = 0
+	exitFlushFailed = 3 // some events could neither be shipped nor spooled during shutdown
+)
+
+// run tails the configured files and ships their lines until SIGTERM or
+// SIGINT arrives, reloading the config file on SIGHUP and when it changes.
+// On shutdown it stops the tailers, drains what they already read, flushes
+// every batch within cfg.ShutdownTimeout and returns an exit code.
+func run(cfg Config) int {
+	// ctx stops the tailers when a signal arrives; shipping uses its own
+	// context so batches can still be flushed after that
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	shipCtx, cancelShip := context.WithCancel(context.Background())
+	defer cancelShip()
+
+	setAgentMetadata(cfg)
+
+	if _, ok := defaultStream(cfg); cfg.Discovery.Enabled && cfg.Discovery.DefaultStream != "" && !ok {
+		log.Printf("WARNING: discovery.default_stream '%s' does not match any stream - unclaimed files will not be shipped", cfg.Discovery.DefaultStream)
+	}
 
-	// Create separate channels and batches for each stream
-	type streamData struct {
-		stream StreamConfig
-		lines  chan LogLine
-		batch  []Event
+	// Shipping without the filters, redaction or TLS settings a stream asks
+	// for would leak or lose data
+	if err := validateRequired(cfg); err != nil {
+		log.Fatalf("Invalid config: %v", err)
 	}
 
-	streamMap := make(map[string]*streamData)
-	var wg sync.WaitGroup
+	stateDir := resolveStateDir(cfg)
+	reg := openStateRegistry(stateDir)
 
-	// Set up tailing for each stream's files
-	for _, mapping := range mappings {
-		sd := &streamData{
-			stream: mapping.Stream,
-			lines:  make(chan LogLine, 100),
-			batch:  make([]Event, 0, 100),
-		}
-		streamMap[mapping.Stream.Name] = sd
-
-		// Start tailing all files for this stream
-		for _, f := range mapping.Files {
-			wg.Add(1)
-			go func(filename string, ch chan LogLine) {
-				defer wg.Done()
-				tailFile(ctx, filename, ch)
-			}(f, sd.lines)
-		}
+	sv := newSupervisor(ctx, shipCtx, cfg, stateDir, reg)
+
+	// Set up a pipeline for each stream, whether or not its files exist yet
+	for _, stream := range cfg.Streams {
+		checkPaths(stream)
+		sv.startStream(cfg, stream)
 	}
 
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	// Tailers come and go as files matching the stream globs appear and
+	// disappear; the pipelines' input is closed once every tailer has stopped
+	sv.tailers = newTailerSet(cfg, reg, sv.pipelines())
+	go sv.tailers.run(ctx)
 
-	// Process events from all streams
-	for {
-		select {
-		case <-ticker.C:
-			// Ship batches for all streams
-			for streamName, sd := range streamMap {
-				if len(sd.batch) > 0 {
-					if os.Getenv("DEBUG") == "1" {
-						log.Printf("Timer tick, shipping %d events for stream '%s'", len(sd.batch), streamName)
-					}
-					if err := shipEvents(ctx, sd.stream, "", sd.batch); err != nil {
-						log.Printf("ship to stream '%s': %v", streamName, err)
-					} else if os.Getenv("DEBUG") == "1" {
-						log.Printf("Successfully shipped %d events to stream '%s'", len(sd.batch), streamName)
-					}
-					sd.batch = sd.batch[:0]
-				}
-			}
-		case <-ctx.Done():
-			wg.Wait()
-			return
-		default:
-			// Check for new lines from any stream
-			for streamName, sd := range streamMap {
-				select {
-				case ll := <-sd.lines:
-					if os.Getenv("DEBUG") == "1" {
-						log.Printf("Processing line from %s (stream '%s'): %s", ll.File, streamName, ll.Line)
-					}
-					ev, ok := parseLine(ll)
-					if ok && ev != nil {
-						sd.batch = append(sd.batch, ev)
-						if os.Getenv("DEBUG") == "1" {
-							log.Printf("Parsed event for stream '%s': %+v", streamName, ev)
-						}
-						if len(sd.batch) >= 100 {
-							if os.Getenv("DEBUG") == "1" {
-								log.Printf("Batch full, shipping %d events for stream '%s'", len(sd.batch), streamName)
-							}
-							if err := shipEvents(ctx, sd.stream, "", sd.batch); err != nil {
-								log.Printf("ship to stream '%s': %v", streamName, err)
-							} else if os.Getenv("DEBUG") == "1" {
-								log.Printf("Successfully shipped batch of %d events to stream '%s'", len(sd.batch), streamName)
-							}
-							sd.batch = sd.batch[:0]
-						}
-					}
-				default:
-					// No new lines for this stream, continue
-				}
-			}
-		}
+	// SIGHUP and edits to the config file restart the streams that changed
+	go sv.watch(configPath)
+
+	<-ctx.Done()
+	timeout := sv.config().ShutdownTimeout
+	log.Printf("Shutting down: flushing pending events (timeout %v)", timeout)
+
+	// Deliveries still running when the timeout expires are cancelled, which
+	// sends their batches to the spool
+	flushTimer := time.AfterFunc(timeout, cancelShip)
+	failed := sv.shutdown()
+	flushTimer.Stop()
+
+	if failed {
+		log.Printf("Shutdown complete, but some events could not be delivered or spooled")
+		return exitFlushFailed
 	}
+	log.Printf("Shutdown complete")
+	return exitOK
 }
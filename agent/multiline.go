@@ -0,0 +1,170 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines     = 500
+	defaultMultilineMaxBytes     = 256 * 1024
+	defaultMultilineFlushTimeout = time.Second
+)
+
+// MultilineConfig joins consecutive lines of a file into one event, so that
+// a stack trace arrives as a single event. Either Start decides (every line
+// that does not match it belongs to the previous event), or Continuation
+// and/or Indented do (matching lines belong to the previous event).
+type MultilineConfig struct {
+	Start        string        `yaml:"start,omitempty"`         // Regexp matching the first line of an event
+	Continuation string        `yaml:"continuation,omitempty"`  // Regexp matching lines that continue the previous event
+	Indented     bool          `yaml:"indented,omitempty"`      // Lines starting with a space or tab continue the previous event
+	MaxLines     int           `yaml:"max_lines,omitempty"`     // Lines per event before a new one is started (default 500)
+	MaxBytes     int           `yaml:"max_bytes,omitempty"`     // Bytes per event before a new one is started (default 256 KiB)
+	FlushTimeout time.Duration `yaml:"flush_timeout,omitempty"` // How long to wait for more lines before shipping an event (default 1s)
+}
+
+func (m MultilineConfig) enabled() bool {
+	return m.Start != "" || m.Continuation != "" || m.Indented
+}
+
+// assembler applies a stream's multiline rules, keeping one event open per file.
+type assembler struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	indented     bool
+	maxLines     int
+	maxBytes     int
+	timeout      time.Duration
+	pending      map[string]*openEvent
+}
+
+// openEvent is an event that may still receive continuation lines.
+type openEvent struct {
+	ll    LogLine // Line holds the joined text, Pos the position past the last line
+	lines int
+	last  time.Time
+}
+
+func newAssembler(cfg MultilineConfig) (*assembler, error) {
+	a := &assembler{
+		indented: cfg.Indented,
+		maxLines: cfg.MaxLines,
+		maxBytes: cfg.MaxBytes,
+		timeout:  cfg.FlushTimeout,
+		pending:  make(map[string]*openEvent),
+	}
+	var err error
+	if cfg.Start != "" {
+		if a.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Continuation != "" {
+		if a.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, err
+		}
+	}
+	if a.maxLines <= 0 {
+		a.maxLines = defaultMultilineMaxLines
+	}
+	if a.maxBytes <= 0 {
+		a.maxBytes = defaultMultilineMaxBytes
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultMultilineFlushTimeout
+	}
+	return a, nil
+}
+
+// continues reports whether line belongs to the event before it.
+func (a *assembler) continues(line string) bool {
+	if a.start != nil {
+		return !a.start.MatchString(line)
+	}
+	if a.continuation != nil && a.continuation.MatchString(line) {
+		return true
+	}
+	return a.indented && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"))
+}
+
+// add feeds one line and returns the event it completed, if any. An event
+// that reaches the line or byte limit is closed and the line starts a new one.
+func (a *assembler) add(ll LogLine, now time.Time) (LogLine, bool) {
+	ev := a.pending[ll.File]
+	if ev != nil && a.continues(ll.Line) && ev.lines < a.maxLines && len(ev.ll.Line)+1+len(ll.Line) <= a.maxBytes {
+		ev.ll.Line += "\n" + ll.Line
+		ev.ll.Pos = ll.Pos
+		ev.lines++
+		ev.last = now
+		return LogLine{}, false
+	}
+
+	a.pending[ll.File] = &openEvent{ll: ll, lines: 1, last: now}
+	if ev == nil {
+		return LogLine{}, false
+	}
+	return ev.ll, true
+}
+
+// expired removes and returns the events that saw no new line for the flush timeout.
+func (a *assembler) expired(now time.Time) []LogLine {
+	var done []LogLine
+	for file, ev := range a.pending {
+		if now.Sub(ev.last) >= a.timeout {
+			done = append(done, ev.ll)
+			delete(a.pending, file)
+		}
+	}
+	return done
+}
+
+// nextExpiry returns when the oldest open event times out.
+func (a *assembler) nextExpiry() (time.Time, bool) {
+	var next time.Time
+	for _, ev := range a.pending {
+		if t := ev.last.Add(a.timeout); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// run assembles lines from in and writes whole events to out. Open events
+// are flushed when in is closed, after which out is closed.
+func (a *assembler) run(in <-chan LogLine, out chan<- LogLine) {
+	defer close(out)
+	timer := time.NewTimer(a.timeout)
+	timer.Stop()
+	defer timer.Stop()
+
+	armTimer := func() {
+		timer.Stop()
+		if next, ok := a.nextExpiry(); ok {
+			timer.Reset(time.Until(next))
+		}
+	}
+
+	for {
+		select {
+		case ll, ok := <-in:
+			if !ok {
+				for _, ev := range a.expired(time.Now().Add(a.timeout)) {
+					out <- ev
+				}
+				return
+			}
+			if ev, ok := a.add(ll, time.Now()); ok {
+				out <- ev
+			}
+			armTimer()
+
+		case <-timer.C:
+			for _, ev := range a.expired(time.Now()) {
+				out <- ev
+			}
+			armTimer()
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assemble feeds lines from a single file through a and returns the events.
+func assemble(t *testing.T, a *assembler, file string, lines ...string) []string {
+	t.Helper()
+	var events []string
+	now := time.Now()
+	for _, line := range lines {
+		if ev, ok := a.add(LogLine{File: file, Line: line}, now); ok {
+			events = append(events, ev.Line)
+		}
+	}
+	for _, ev := range a.expired(now.Add(a.timeout)) {
+		events = append(events, ev.Line)
+	}
+	return events
+}
+
+func TestMultilineRules(t *testing.T) {
+	javaTrace := []string{
+		"2024-05-01 12:00:00 ERROR Request failed",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.Handler.handle(Handler.java:42)",
+		"\tat com.example.Server.run(Server.java:7)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 2 more",
+		"2024-05-01 12:00:01 INFO Next request",
+	}
+
+	tests := []struct {
+		name  string
+		cfg   MultilineConfig
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "start pattern",
+			cfg:   MultilineConfig{Start: `^\d{4}-\d{2}-\d{2} `},
+			lines: javaTrace,
+			want: []string{
+				strings.Join(javaTrace[:6], "\n"),
+				javaTrace[6],
+			},
+		},
+		{
+			name:  "continuation pattern and indentation",
+			cfg:   MultilineConfig{Continuation: `^(Caused by:|java\.)`, Indented: true},
+			lines: javaTrace,
+			want: []string{
+				strings.Join(javaTrace[:6], "\n"),
+				javaTrace[6],
+			},
+		},
+		{
+			name: "python traceback",
+			cfg:  MultilineConfig{Start: `^(\[|Traceback)`},
+			lines: []string{
+				"[2024-05-01] started",
+				"Traceback (most recent call last):",
+				`  File "app.py", line 3, in <module>`,
+				"ValueError: bad value",
+				"[2024-05-01] done",
+			},
+			want: []string{
+				"[2024-05-01] started",
+				"Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>\nValueError: bad value",
+				"[2024-05-01] done",
+			},
+		},
+		{
+			name:  "max lines",
+			cfg:   MultilineConfig{Indented: true, MaxLines: 2},
+			lines: []string{"start", " one", " two", " three"},
+			want:  []string{"start\n one", " two\n three"},
+		},
+		{
+			name:  "max bytes",
+			cfg:   MultilineConfig{Indented: true, MaxBytes: 10},
+			lines: []string{"start", " one", " two"},
+			want:  []string{"start\n one", " two"},
+		},
+		{
+			name:  "leading continuation without an event",
+			cfg:   MultilineConfig{Indented: true},
+			lines: []string{" orphan", " more", "next"},
+			want:  []string{" orphan\n more", "next"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAssembler(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := assemble(t, a, "/app.log", tt.lines...)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %d events, got %d: %q", len(tt.want), len(got), got)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d: expected %q, got %q", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMultilineKeepsFilesApart(t *testing.T) {
+	a, err := newAssembler(MultilineConfig{Indented: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.add(LogLine{File: "/a.log", Line: "a start"}, now)
+	a.add(LogLine{File: "/b.log", Line: "b start"}, now)
+	a.add(LogLine{File: "/a.log", Line: " a more"}, now)
+	a.add(LogLine{File: "/b.log", Line: " b more"}, now)
+
+	got := make(map[string]string)
+	for _, ev := range a.expired(now.Add(a.timeout)) {
+		got[ev.File] = ev.Line
+	}
+	if got["/a.log"] != "a start\n a more" || got["/b.log"] != "b start\n b more" {
+		t.Errorf("lines of different files were mixed: %q", got)
+	}
+}
+
+func TestMultilineEventKeepsLastPosition(t *testing.T) {
+	a, err := newAssembler(MultilineConfig{Indented: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.add(LogLine{File: "/a.log", Line: "start", Pos: FilePosition{Inode: 1, Offset: 6}}, now)
+	a.add(LogLine{File: "/a.log", Line: " more", Pos: FilePosition{Inode: 1, Offset: 12}}, now)
+	ev, ok := a.add(LogLine{File: "/a.log", Line: "next", Pos: FilePosition{Inode: 1, Offset: 17}}, now)
+	if !ok {
+		t.Fatal("expected the first event to be complete")
+	}
+	// The checkpoint must not move past lines still held in an open event
+	if ev.Pos.Offset != 12 {
+		t.Errorf("expected the event to end at offset 12, got %d", ev.Pos.Offset)
+	}
+}
+
+func TestMultilineInvalidPattern(t *testing.T) {
+	if _, err := newAssembler(MultilineConfig{Start: "("}); err == nil {
+		t.Error("expected an error for an invalid start pattern")
+	}
+	p := newPipeline(StreamConfig{Name: "test", Multiline: MultilineConfig{Start: "("}}, nil, nil)
+	if p.multiline != nil {
+		t.Error("expected an invalid rule to disable multiline assembly")
+	}
+}
+
+// TestPipelineShipsStackTraceAsOneEvent checks that the pipeline ships a
+// trace as one event once no more lines arrive within the flush timeout.
+func TestPipelineShipsStackTraceAsOneEvent(t *testing.T) {
+	received := make(chan []LogEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var events []LogEvent
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var ev LogEvent
+			if json.Unmarshal(line, &ev) == nil {
+				events = append(events, ev)
+			}
+		}
+		received <- events
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	p := newPipeline(StreamConfig{
+		Name:      "test",
+		StreamID:  "test",
+		URL:       srv.URL,
+		Multiline: MultilineConfig{Indented: true, FlushTimeout: 100 * time.Millisecond},
+	}, nil, nil)
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(context.Background(), stopping)
+	}()
+
+	for _, line := range []string{"Exception in thread main", "\tat A.b(A.java:1)", "\tat C.d(C.java:2)"} {
+		p.lines <- LogLine{File: "stdin", Line: line}
+	}
+	close(stopping)
+	close(p.lines)
+	<-done
+
+	select {
+	case events := <-received:
+		if len(events) != 1 {
+			t.Fatalf("expected one event, got %d: %+v", len(events), events)
+		}
+		if want := "Exception in thread main\n\tat A.b(A.java:1)\n\tat C.d(C.java:2)"; events[0].Log != want {
+			t.Errorf("expected %q, got %q", want, events[0].Log)
+		}
+	default:
+		t.Fatal("nothing was shipped")
+	}
+}
+
+func TestAssemblerFlushesAfterTimeout(t *testing.T) {
+	a, err := newAssembler(MultilineConfig{Indented: true, FlushTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan LogLine)
+	out := make(chan LogLine, 10)
+	go a.run(in, out)
+	defer close(in)
+
+	in <- LogLine{File: "/a.log", Line: "only line"}
+	select {
+	case ev := <-out:
+		if ev.Line != "only line" {
+			t.Errorf("expected 'only line', got %q", ev.Line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("open event was not flushed after the timeout")
+	}
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -94,3 +101,140 @@ func TestNDJSONContentType(t *testing.T) {
 		t.Errorf("Content-Type should be application/x-ndjson")
 	}
 }
+
+// ingestRequest is what decodingServer saw of one request.
+type ingestRequest struct {
+	encoding string
+	size     int    // bytes on the wire
+	body     string // decoded payload
+}
+
+// decodingServer records each request with its body decoded according to
+// Content-Encoding. With acceptGzip unset it answers gzip requests with 415.
+func decodingServer(t *testing.T, acceptGzip bool) (*httptest.Server, func() []ingestRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var reqs []ingestRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		req := ingestRequest{encoding: r.Header.Get("Content-Encoding"), size: len(raw), body: string(raw)}
+		if req.encoding == "gzip" {
+			if !acceptGzip {
+				mu.Lock()
+				reqs = append(reqs, req)
+				mu.Unlock()
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			decoded, err := io.ReadAll(zr)
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+			}
+			req.body = string(decoded)
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []ingestRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]ingestRequest(nil), reqs...)
+	}
+}
+
+func accessLogEvents(n int) []Event {
+	events := make([]Event, n)
+	for i := range events {
+		events[i] = LogEvent{
+			Log:      fmt.Sprintf(`192.168.1.%d - - [22/Sep/2025:17:04:36 +0000] "GET /api/items HTTP/1.1" 200 512 "-" "curl/8.0"`, i%255),
+			Filename: "/var/log/nginx/access.log",
+		}
+	}
+	return events
+}
+
+func TestNDJSONGzipPayload(t *testing.T) {
+	srv, requests := decodingServer(t, true)
+	stream := StreamConfig{Name: "nginx", StreamID: "test", URL: srv.URL, Compression: compressionGzip}
+	events := accessLogEvents(100)
+
+	if err := shipEvents(context.Background(), stream, "token", events); err != nil {
+		t.Fatalf("shipEvents failed: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected one request, got %d", len(reqs))
+	}
+	want := string(encodeNDJSON(events))
+	if reqs[0].encoding != "gzip" || reqs[0].body != want {
+		t.Fatalf("expected the gzip-encoded NDJSON payload, got encoding %q and body %q", reqs[0].encoding, reqs[0].body)
+	}
+	if reqs[0].size*5 > len(want) {
+		t.Errorf("expected access logs to compress well, sent %d bytes for %d", reqs[0].size, len(want))
+	}
+	for i, line := range strings.Split(strings.TrimSpace(reqs[0].body), "\n") {
+		var ev LogEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Errorf("line %d is not valid JSON: %v", i+1, err)
+		}
+	}
+}
+
+func TestNDJSONSmallPayloadIsNotCompressed(t *testing.T) {
+	srv, requests := decodingServer(t, true)
+	stream := StreamConfig{Name: "nginx", StreamID: "test", URL: srv.URL, Compression: compressionGzip}
+
+	if err := shipEvents(context.Background(), stream, "token", accessLogEvents(1)); err != nil {
+		t.Fatalf("shipEvents failed: %v", err)
+	}
+	if reqs := requests(); len(reqs) != 1 || reqs[0].encoding != "" {
+		t.Errorf("expected one uncompressed request, got %+v", reqs)
+	}
+}
+
+func TestNDJSONUncompressedByDefault(t *testing.T) {
+	srv, requests := decodingServer(t, true)
+	stream := StreamConfig{Name: "nginx", StreamID: "test", URL: srv.URL}
+
+	if err := shipEvents(context.Background(), stream, "token", accessLogEvents(100)); err != nil {
+		t.Fatalf("shipEvents failed: %v", err)
+	}
+	if reqs := requests(); len(reqs) != 1 || reqs[0].encoding != "" {
+		t.Errorf("expected one uncompressed request, got %+v", reqs)
+	}
+}
+
+func TestNDJSONGzipFallback(t *testing.T) {
+	srv, requests := decodingServer(t, false)
+	stream := StreamConfig{Name: "nginx", StreamID: "test", URL: srv.URL, Compression: compressionGzip}
+	events := accessLogEvents(100)
+
+	for i := 0; i < 2; i++ {
+		if err := shipEvents(context.Background(), stream, "token", events); err != nil {
+			t.Fatalf("shipEvents %d failed: %v", i+1, err)
+		}
+	}
+
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected a rejected gzip request and two plain ones, got %+v", reqs)
+	}
+	if reqs[0].encoding != "gzip" {
+		t.Errorf("expected the first request to be compressed, got %q", reqs[0].encoding)
+	}
+	for _, r := range reqs[1:] {
+		if r.encoding != "" || r.body != string(encodeNDJSON(events)) {
+			t.Errorf("expected the plain NDJSON payload after the rejection, got encoding %q", r.encoding)
+		}
+	}
+}
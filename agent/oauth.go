@@ -80,8 +80,9 @@ type StreamsResponse struct {
 	Streams []Stream `json:"streams"`
 }
 
-// setupOAuth runs the OAuth Device Code Flow setup
-func setupOAuth() error {
+// setupOAuth runs the OAuth Device Code Flow setup. httpCfg, from any
+// existing config, is kept in the config it writes.
+func setupOAuth(httpCfg HTTPConfig) error {
 	fmt.Println("🚀 Tailstream Agent Setup")
 	fmt.Println()
 
@@ -120,6 +121,7 @@ func setupOAuth() error {
 
 	// Step 6: Save configuration
 	cfg := createOAuthConfig([]StreamConfig{*selectedStream})
+	cfg.HTTP = httpCfg
 	if err := saveConfig(cfg); err != nil {
 		return fmt.Errorf("failed to save config: %v", err)
 	}
@@ -141,7 +143,7 @@ func requestDeviceCode() (*DeviceCodeResponse, error) {
 		"scope":     {"stream:read stream:write stream:create"},
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 	resp, err := client.PostForm(getBaseURL()+"/api/oauth/device/code", data)
 	if err != nil {
 		return nil, err
@@ -170,7 +172,7 @@ func pollForToken(deviceCode string, interval int) (*TokenResponse, error) {
 
 	timeout := time.Now().Add(10 * time.Minute)
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 
 	for time.Now().Before(timeout) {
 		resp, err := client.PostForm(getBaseURL()+"/api/oauth/device/token", data)
@@ -204,7 +206,7 @@ func pollForToken(deviceCode string, interval int) (*TokenResponse, error) {
 
 // fetchUserData retrieves the user's streams and plan information
 func fetchUserData(accessToken string) ([]Stream, UserPlan, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 
 	// Fetch streams
 	req, err := http.NewRequest("GET", getBaseURL()+"/api/user/streams", nil)
@@ -255,7 +257,7 @@ func fetchUserData(accessToken string) ([]Stream, UserPlan, error) {
 
 // fetchStreamDetails retrieves detailed information for a specific stream including ingest token
 func fetchStreamDetails(streamID string, accessToken string) (*Stream, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 
 	req, err := http.NewRequest("GET", getBaseURL()+"/api/streams/"+streamID, nil)
 	if err != nil {
@@ -371,7 +373,7 @@ func createStreamWithName(name, accessToken string) (*StreamConfig, error) {
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -506,13 +508,7 @@ func createOAuthConfig(streams []StreamConfig) Config {
 	return Config{
 		Env: "production",
 		// No global Key field - each stream has its own ingest token
-		Discovery: struct {
-			Enabled bool `yaml:"enabled"`
-			Paths   struct {
-				Include []string `yaml:"include"`
-				Exclude []string `yaml:"exclude"`
-			} `yaml:"paths"`
-		}{
+		Discovery: DiscoveryConfig{
 			Enabled: true,
 		},
 		// No Ship section - legacy single-stream config not needed
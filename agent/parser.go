@@ -1,5 +1,17 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// metaKey is the reserved key under which the agent's metadata is added to
+// lines shipped as JSON objects.
+const metaKey = "_tailstream"
+
 // Event is the normalized record to send to Tailstream.
 // Events are sent as structured JSON with metadata - the backend handles log parsing.
 type Event interface{}
@@ -8,14 +20,170 @@ type Event interface{}
 type LogEvent struct {
 	Log      string `json:"log"`
 	Filename string `json:"filename"`
+	// Fields holds the parsed line when the stream declares a format
+	Fields *AccessFields `json:"fields,omitempty"`
+	// ParseError is set when the line did not match the stream's format;
+	// the line is still shipped raw
+	ParseError string `json:"parse_error,omitempty"`
+	// ObservedAt is when the agent read the line
+	ObservedAt time.Time `json:"observed_at"`
+	// Timestamp is when the event happened, if it could be extracted
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Labels are the values captured from the file's path
+	Labels map[string]string `json:"labels,omitempty"`
+	// Truncated is set when the event was too large for a batch and Log was
+	// cut; OriginalBytes is the length of the full line
+	Truncated     bool `json:"truncated,omitempty"`
+	OriginalBytes int  `json:"original_bytes,omitempty"`
 }
 
 // parseLine returns the log line with filename metadata - backend handles all parsing
 func parseLine(ll LogLine) (Event, bool) {
+	return parseLineFormat(ll, "")
+}
+
+// lineParser turns the lines of one stream into events: it applies the
+// stream's format and records when each event was observed and happened.
+type lineParser struct {
+	format    string
+	timestamp *timestampExtractor
+}
+
+func newLineParser(stream StreamConfig) lineParser {
+	var lp lineParser
+	if validFormat(stream.Format) {
+		lp.format = stream.Format
+	} else {
+		log.Printf("ERROR: Unknown format '%s' for stream '%s' - shipping lines raw", stream.Format, stream.Name)
+	}
+	if stream.Timestamp.enabled() {
+		x, err := newTimestampExtractor(stream.Timestamp)
+		if err != nil {
+			log.Printf("ERROR: Invalid timestamp rule for stream '%s': %v - events carry no event time", stream.Name, err)
+		} else {
+			lp.timestamp = x
+		}
+	}
+	return lp
+}
+
+func (lp lineParser) parse(ll LogLine) (Event, bool) {
+	ev, ok := parseLineFormat(ll, lp.format)
+	if !ok {
+		return nil, false
+	}
+
+	observed := ll.ObservedAt
+	if observed.IsZero() {
+		observed = time.Now()
+	}
+	observed = observed.UTC()
+
+	switch e := ev.(type) {
+	case LogEvent:
+		e.ObservedAt = observed
+		if lp.timestamp != nil {
+			if ts, ok := lp.timestamp.fromLine(ll.Line); ok {
+				e.Timestamp = &ts
+			}
+		} else if e.Fields != nil {
+			e.Timestamp = e.Fields.Timestamp
+		}
+		return e, true
+	case JSONEvent:
+		e.Meta.ObservedAt = observed
+		if lp.timestamp != nil {
+			var ts time.Time
+			var ok bool
+			if lp.timestamp.pattern != nil {
+				ts, ok = lp.timestamp.fromLine(ll.Line)
+			} else {
+				ts, ok = lp.timestamp.fromObject(e.Object)
+			}
+			if ok {
+				e.Meta.Timestamp = &ts
+			}
+		}
+		return e, true
+	}
+	return ev, true
+}
+
+// JSONEvent is a line holding a JSON object. It is shipped as that object,
+// with the agent's metadata added under metaKey.
+type JSONEvent struct {
+	Object map[string]json.RawMessage
+	Meta   EventMeta
+}
+
+// EventMeta is the metadata added to a JSONEvent.
+type EventMeta struct {
+	Filename   string            `json:"filename"`
+	ObservedAt time.Time         `json:"observed_at"`
+	Timestamp  *time.Time        `json:"timestamp,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+func (e JSONEvent) MarshalJSON() ([]byte, error) {
+	meta, err := json.Marshal(e.Meta)
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]json.RawMessage, len(e.Object)+1)
+	for k, v := range e.Object {
+		obj[k] = v
+	}
+	obj[metaKey] = meta
+	return json.Marshal(obj)
+}
+
+// parseLineFormat is parseLine for a stream with a `format:`. Lines that do
+// not match the format fall back to raw with a parse error.
+func parseLineFormat(ll LogLine, format string) (Event, bool) {
+	if format == formatJSON {
+		return parseJSONLine(ll), true
+	}
+
 	// Send the raw line with filename metadata
 	// The backend will parse the log field while having context about its source
-	return LogEvent{
+	ev := LogEvent{
+		Log:      ll.Line,
+		Filename: ll.File,
+		Labels:   ll.Labels,
+	}
+	fields, err := parseFormat(format, ll.Line)
+	if err != nil {
+		ev.ParseError = err.Error()
+	}
+	ev.Fields = fields
+	return ev, true
+}
+
+// parseJSONLine ships a line holding a JSON object as that object. Lines
+// that do not start with '{' are plain text and are shipped raw. Lines that
+// start with '{' but are not one complete, valid object (including a partial
+// object cut off mid-write) are shipped raw with a parse error, as are
+// objects that already use metaKey, so nothing the application wrote is lost
+// or overwritten.
+func parseJSONLine(ll LogLine) Event {
+	ev := LogEvent{
 		Log:      ll.Line,
 		Filename: ll.File,
-	}, true
+		Labels:   ll.Labels,
+	}
+	trimmed := strings.TrimSpace(ll.Line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return ev
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(trimmed), &obj); err != nil {
+		ev.ParseError = fmt.Sprintf("invalid JSON: %v", err)
+		return ev
+	}
+	if _, ok := obj[metaKey]; ok {
+		ev.ParseError = fmt.Sprintf("JSON object uses the reserved key %q", metaKey)
+		return ev
+	}
+	return JSONEvent{Object: obj, Meta: EventMeta{Filename: ll.File, Labels: ll.Labels}}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// captureName matches a named capture such as {site} in a stream path. A
+// brace group holding a single identifier is never useful as a doublestar
+// alternation, so it is read as a capture instead.
+var captureName = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// pathPattern is a stream path whose named captures, like {site} in
+// /var/log/nginx/{site}/access.log, become labels on the events of every
+// file it matches. A capture matches like * within a single path segment.
+type pathPattern struct {
+	glob string         // the pattern with every capture replaced by *
+	re   *regexp.Regexp // extracts the capture values; nil without captures
+}
+
+func compilePathPattern(pattern string) (pathPattern, error) {
+	p := pathPattern{glob: captureName.ReplaceAllString(pattern, "*")}
+	if p.glob == pattern {
+		return p, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range captureName.FindAllStringSubmatch(pattern, -1) {
+		if seen[m[1]] {
+			return pathPattern{}, fmt.Errorf("capture {%s} appears more than once in %s", m[1], pattern)
+		}
+		seen[m[1]] = true
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return pathPattern{}, fmt.Errorf("invalid path pattern %s: %v", pattern, err)
+	}
+	p.re = re
+	return p, nil
+}
+
+// captures returns the capture values for path, which must be a match of
+// p.glob. It returns nil for patterns without captures.
+func (p pathPattern) captures(path string) map[string]string {
+	if p.re == nil {
+		return nil
+	}
+	m := p.re.FindStringSubmatch(path)
+	if m == nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	for i, name := range p.re.SubexpNames() {
+		if name != "" {
+			labels[name] = m[i]
+		}
+	}
+	return labels
+}
+
+// globToRegexp translates a doublestar pattern into a regular expression,
+// turning captures into named groups.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	depth := 0 // nesting of {a,b} alternations
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case strings.HasPrefix(pattern[i:], "**"):
+			// ** spans any number of segments, including none
+			switch {
+			case strings.HasPrefix(pattern[i:], "**/"):
+				b.WriteString("(?:.*/)?")
+				i += 2
+			default:
+				b.WriteString(".*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '{':
+			if m := captureName.FindStringSubmatch(pattern[i:]); m != nil && strings.HasPrefix(pattern[i:], m[0]) {
+				b.WriteString("(?P<" + m[1] + ">[^/]+)")
+				i += len(m[0]) - 1
+				continue
+			}
+			depth++
+			b.WriteString("(?:")
+		case c == ',' && depth > 0:
+			b.WriteString("|")
+		case c == '}' && depth > 0:
+			depth--
+			b.WriteString(")")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return b.String()
+}
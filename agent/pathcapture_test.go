@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPathPatternCaptures(t *testing.T) {
+	tests := []struct {
+		pattern string
+		glob    string
+		path    string
+		want    map[string]string
+	}{
+		{"/var/log/nginx/{site}/access.log", "/var/log/nginx/*/access.log", "/var/log/nginx/shop/access.log", map[string]string{"site": "shop"}},
+		{"/srv/{app}/logs/*.log", "/srv/*/logs/*.log", "/srv/billing/logs/worker.log", map[string]string{"app": "billing"}},
+		{"/srv/{app}/**/{name}.log", "/srv/*/**/*.log", "/srv/api/a/b/error.log", map[string]string{"app": "api", "name": "error"}},
+		{"/srv/{app}/{access,error}.log", "/srv/*/{access,error}.log", "/srv/api/error.log", map[string]string{"app": "api"}},
+		{"/var/log/{host}-[0-9].log", "/var/log/*-[0-9].log", "/var/log/web.example.com-3.log", map[string]string{"host": "web.example.com"}},
+		{"/var/log/*.log", "/var/log/*.log", "/var/log/syslog.log", nil},
+	}
+	for _, tt := range tests {
+		p, err := compilePathPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if p.glob != tt.glob {
+			t.Errorf("%s: glob = %q, want %q", tt.pattern, p.glob, tt.glob)
+		}
+		if got := p.captures(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: captures(%s) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathPatternRejectsRepeatedCapture(t *testing.T) {
+	if _, err := compilePathPattern("/srv/{app}/{app}.log"); err == nil {
+		t.Error("expected an error for a capture used twice")
+	}
+}
+
+func TestDiscoverKeepsPathLabels(t *testing.T) {
+	dir := t.TempDir()
+	for _, site := range []string{"shop", "blog"} {
+		if err := os.MkdirAll(filepath.Join(dir, site), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		touchFiles(t, filepath.Join(dir, site), "access.log")
+	}
+
+	cfg := Config{Streams: []StreamConfig{{Name: "nginx", Paths: []string{filepath.Join(dir, "{site}", "access.log")}}}}
+	mappings, err := discover(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 || len(mappings[0].Files) != 2 {
+		t.Fatalf("expected both sites' files, got %+v", mappings)
+	}
+	for _, f := range mappings[0].Files {
+		want := filepath.Base(filepath.Dir(f))
+		if got := mappings[0].Labels[f]["site"]; got != want {
+			t.Errorf("%s: site = %q, want %q", f, got, want)
+		}
+	}
+}
+
+func TestPathLabelsOnEvents(t *testing.T) {
+	labels := map[string]string{"site": "shop"}
+
+	ev, _ := parseLineFormat(LogLine{File: "/var/log/nginx/shop/access.log", Line: "GET /", Labels: labels}, "")
+	b, _ := json.Marshal(ev)
+	var logEvent struct {
+		Labels map[string]string `json:"labels"`
+	}
+	json.Unmarshal(b, &logEvent)
+	if !reflect.DeepEqual(logEvent.Labels, labels) {
+		t.Errorf("raw event: labels = %v, want %v (%s)", logEvent.Labels, labels, b)
+	}
+
+	ev, _ = parseLineFormat(LogLine{File: "/srv/shop/app.log", Line: `{"msg":"hi"}`, Labels: labels}, formatJSON)
+	b, _ = json.Marshal(ev)
+	var jsonEvent struct {
+		Meta EventMeta `json:"_tailstream"`
+	}
+	json.Unmarshal(b, &jsonEvent)
+	if !reflect.DeepEqual(jsonEvent.Meta.Labels, labels) {
+		t.Errorf("json event: labels = %v, want %v (%s)", jsonEvent.Meta.Labels, labels, b)
+	}
+}
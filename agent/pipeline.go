@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Batch limits for streams that do not set their own.
+const (
+	maxBatchEvents = 100
+	maxBatchBytes  = 1 << 20
+	batchLinger    = 2 * time.Second
+	// pipelineQueueSize is how many full batches may wait for the sender
+	// before reading from the stream pauses
+	pipelineQueueSize = 4
+)
+
+// pendingBatch is a batch of events together with the file positions it covers.
+type pendingBatch struct {
+	events    []Event
+	positions map[string]FilePosition
+	size      int // encoded NDJSON bytes
+	// meta describes every event of the batch, as of when its first event
+	// was added
+	meta *batchMetadata
+}
+
+func newPendingBatch() pendingBatch {
+	return pendingBatch{
+		events:    make([]Event, 0, maxBatchEvents),
+		positions: make(map[string]FilePosition),
+	}
+}
+
+// streamPipeline turns the lines of one stream into batches and ships them.
+// Each stream has its own pipeline, so a slow or failing endpoint only holds
+// up its own stream. Batching and shipping run in separate goroutines, so
+// reading continues while a batch is in flight.
+type streamPipeline struct {
+	stream StreamConfig
+	lines  chan LogLine
+	spool  *Spool
+	reg    *Registry
+	// multiline joins lines into events before batching; nil ships every
+	// line as its own event
+	multiline *assembler
+	parser    lineParser
+	// filter drops unwanted events before batching; nil ships everything
+	filter *lineFilter
+	// redactor removes sensitive data from events; nil when not configured
+	redactor *redactor
+	// limiter samples and rate limits events; nil ships everything
+	limiter *limiter
+
+	// failed records that a batch could neither be shipped nor spooled
+	// after shutdown began
+	failed atomic.Bool
+}
+
+func newPipeline(stream StreamConfig, spool *Spool, reg *Registry) *streamPipeline {
+	p := &streamPipeline{
+		stream: stream,
+		lines:  make(chan LogLine, 100),
+		spool:  spool,
+		reg:    reg,
+	}
+	if stream.Multiline.enabled() {
+		a, err := newAssembler(stream.Multiline)
+		if err != nil {
+			log.Printf("ERROR: Invalid multiline rule for stream '%s': %v - shipping lines one by one", stream.Name, err)
+		} else {
+			p.multiline = a
+		}
+	}
+	p.parser = newLineParser(stream)
+	// run and runStdinMode refuse to start with invalid filter or redaction settings
+	if f, err := newLineFilter(stream); err != nil {
+		log.Printf("ERROR: Invalid filters for stream '%s': %v", stream.Name, err)
+	} else {
+		p.filter = f
+	}
+	if r, err := newRedactor(stream.Redact); err != nil {
+		log.Printf("ERROR: Invalid redact settings for stream '%s': %v", stream.Name, err)
+	} else {
+		p.redactor = r
+	}
+	p.limiter = newLimiter(stream, time.Now())
+	if !validCompression(stream.Compression) {
+		log.Printf("ERROR: Unknown compression '%s' for stream '%s' - sending payloads uncompressed", stream.Compression, stream.Name)
+	}
+	return p
+}
+
+// run batches lines until p.lines is closed and every batch has been handed
+// to deliver. shipCtx bounds delivery; stopping is closed once shutdown begins.
+func (p *streamPipeline) run(shipCtx context.Context, stopping <-chan struct{}) {
+	batches := make(chan pendingBatch, pipelineQueueSize)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		p.send(shipCtx, stopping, batches)
+	}()
+
+	lines := p.lines
+	if p.multiline != nil {
+		events := make(chan LogLine, 100)
+		go p.multiline.run(p.lines, events)
+		lines = events
+	}
+
+	p.batch(lines, batches)
+	close(batches)
+	<-sent
+}
+
+// batch collects lines (whole events, with multiline rules) into batches,
+// handing one over when it holds the stream's maximum events or bytes, or
+// when the linger time has passed since its first event. An event that would
+// push a batch over the byte limit goes into the next one, and an event over
+// the limit by itself is shipped alone. It blocks while idle.
+func (p *streamPipeline) batch(in <-chan LogLine, out chan<- pendingBatch) {
+	cfg := p.stream.Batch.withDefaults()
+	b := newPendingBatch()
+	linger := time.NewTimer(cfg.Linger)
+	linger.Stop()
+	defer linger.Stop()
+
+	var report <-chan time.Time
+	if p.filter != nil {
+		ticker := time.NewTicker(filterReportInterval)
+		defer ticker.Stop()
+		report = ticker.C
+		defer p.filter.report(true)
+	}
+	var summary <-chan time.Time
+	if p.limiter != nil {
+		ticker := time.NewTicker(p.limiter.interval)
+		defer ticker.Stop()
+		summary = ticker.C
+	}
+
+	flush := func() {
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("Batch full, shipping %d events (%d bytes) for stream '%s'", len(b.events), b.size, p.stream.Name)
+		}
+		linger.Stop()
+		out <- b
+		b = newPendingBatch()
+	}
+	// add appends ev, read from ll, to the batch. The position of ll goes
+	// with the batch that holds the event, so it is only committed once the
+	// event was delivered.
+	add := func(ev Event, ll LogLine) {
+		size := encodedSize(ev)
+		if size > ingestPayloadLimit {
+			log.Printf("WARNING: Event from %s is %d bytes, over the ingest payload limit of %d for stream '%s' - truncating it", ll.File, size, ingestPayloadLimit, p.stream.Name)
+			ev, size = truncateEvent(ev, ingestPayloadLimit)
+		}
+		if len(b.events) > 0 && b.size+size > cfg.MaxBytes {
+			flush()
+		}
+		if len(b.events) == 0 {
+			linger.Reset(cfg.Linger)
+			b.meta = streamMetadata(p.stream)
+		}
+		b.events = append(b.events, ev)
+		b.size += size
+		if ll.Pos != (FilePosition{}) {
+			b.positions[ll.File] = ll.Pos
+		}
+		if len(b.events) >= cfg.MaxEvents || b.size >= cfg.MaxBytes {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case ll, ok := <-in:
+			if !ok {
+				// Report what the last window shed before the final batch goes out
+				if p.limiter != nil {
+					if ev, ok := p.limiter.summary(time.Now()); ok {
+						add(ev, LogLine{File: summaryFilename})
+					}
+				}
+				if len(b.events) > 0 {
+					out <- b
+				}
+				return
+			}
+			if os.Getenv("DEBUG") == "1" {
+				log.Printf("Processing line from %s (stream '%s'): %s", ll.File, p.stream.Name, ll.Line)
+			}
+			ev, ok := p.parser.parse(ll)
+			dropped := !ok || ev == nil ||
+				(p.filter != nil && !p.filter.allow(ll, ev)) ||
+				(p.limiter != nil && !p.limiter.allow(ll, ev, time.Now()))
+			if dropped {
+				// Nothing of the line is shipped, so the current batch may
+				// commit its position
+				if ll.Pos != (FilePosition{}) {
+					b.positions[ll.File] = ll.Pos
+				}
+				continue
+			}
+			if p.redactor != nil {
+				ev = p.redactor.event(ev)
+			}
+			if os.Getenv("DEBUG") == "1" {
+				log.Printf("Parsed event for stream '%s': %+v", p.stream.Name, ev)
+			}
+			add(ev, ll)
+
+		case <-linger.C:
+			if len(b.events) > 0 {
+				if os.Getenv("DEBUG") == "1" {
+					log.Printf("Timer tick, shipping %d events for stream '%s'", len(b.events), p.stream.Name)
+				}
+				out <- b
+				b = newPendingBatch()
+			}
+
+		case <-report:
+			p.filter.report(false)
+
+		case now := <-summary:
+			if ev, ok := p.limiter.summary(now); ok {
+				add(ev, LogLine{File: summaryFilename})
+			}
+		}
+	}
+}
+
+// send delivers batches in order and, only once a batch was accepted,
+// advances the checkpoints of the files it covered.
+func (p *streamPipeline) send(ctx context.Context, stopping <-chan struct{}, in <-chan pendingBatch) {
+	for b := range in {
+		if err := deliver(ctx, p.stream, p.spool, b.events, b.meta); err != nil {
+			log.Printf("ship to stream '%s': %v", p.stream.Name, err)
+			select {
+			case <-stopping:
+				p.failed.Store(true)
+			default:
+			}
+			continue
+		}
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("Delivered %d events to stream '%s'", len(b.events), p.stream.Name)
+		}
+		if err := p.reg.CommitAll(p.stream.Name, b.positions); err != nil {
+			log.Printf("checkpoint for stream '%s': %v", p.stream.Name, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countingServer reports the number of NDJSON lines in every request it receives.
+func countingServer(t *testing.T, block <-chan struct{}) (*httptest.Server, <-chan int) {
+	t.Helper()
+	batches := make(chan int, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if block != nil {
+			<-block
+		}
+		b, _ := io.ReadAll(r.Body)
+		batches <- len(bytes.Split(bytes.TrimSpace(b), []byte("\n")))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, batches
+}
+
+func startPipeline(t *testing.T, stream StreamConfig) *streamPipeline {
+	t.Helper()
+	p := newPipeline(stream, nil, nil)
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(context.Background(), stopping)
+	}()
+	t.Cleanup(func() {
+		close(stopping)
+		close(p.lines)
+		<-done
+	})
+	return p
+}
+
+func TestPipelineShipsFullBatchImmediately(t *testing.T) {
+	srv, batches := countingServer(t, nil)
+	p := startPipeline(t, StreamConfig{Name: "test", StreamID: "test", URL: srv.URL})
+
+	for i := 0; i < maxBatchEvents; i++ {
+		p.lines <- LogLine{File: "/test.log", Line: "line " + strconv.Itoa(i)}
+	}
+
+	select {
+	case n := <-batches:
+		if n != maxBatchEvents {
+			t.Errorf("expected a batch of %d events, got %d", maxBatchEvents, n)
+		}
+	case <-time.After(batchLinger / 2):
+		t.Fatal("full batch was not shipped before the linger timeout")
+	}
+}
+
+func TestPipelineShipsPartialBatchAfterLinger(t *testing.T) {
+	srv, batches := countingServer(t, nil)
+	p := startPipeline(t, StreamConfig{Name: "test", StreamID: "test", URL: srv.URL})
+
+	start := time.Now()
+	p.lines <- LogLine{File: "/test.log", Line: "only line"}
+
+	select {
+	case n := <-batches:
+		if n != 1 {
+			t.Errorf("expected a batch of 1 event, got %d", n)
+		}
+		if elapsed := time.Since(start); elapsed < batchLinger-100*time.Millisecond {
+			t.Errorf("partial batch shipped after %v, before the linger time", elapsed)
+		}
+	case <-time.After(batchLinger + 2*time.Second):
+		t.Fatal("partial batch was never shipped")
+	}
+}
+
+// TestPipelinesAreIndependent checks there is no head-of-line blocking: a
+// stream whose endpoint hangs must not delay another stream.
+func TestPipelinesAreIndependent(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	slowSrv, _ := countingServer(t, block)
+	fastSrv, fastBatches := countingServer(t, nil)
+
+	slow := startPipeline(t, StreamConfig{Name: "slow", StreamID: "slow", URL: slowSrv.URL})
+	fast := startPipeline(t, StreamConfig{Name: "fast", StreamID: "fast", URL: fastSrv.URL})
+
+	// Enough for the slow stream to have a request in flight and more queued
+	for i := 0; i < 3*maxBatchEvents; i++ {
+		slow.lines <- LogLine{File: "/slow.log", Line: "slow"}
+	}
+	for i := 0; i < maxBatchEvents; i++ {
+		fast.lines <- LogLine{File: "/fast.log", Line: "fast"}
+	}
+
+	select {
+	case <-fastBatches:
+	case <-time.After(batchLinger / 2):
+		t.Fatal("fast stream was held up by the slow stream")
+	}
+}
+
+func TestPipelineFlushesOnClose(t *testing.T) {
+	srv, batches := countingServer(t, nil)
+	p := newPipeline(StreamConfig{Name: "test", StreamID: "test", URL: srv.URL}, nil, nil)
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(context.Background(), stopping)
+	}()
+
+	p.lines <- LogLine{File: "/test.log", Line: "pending"}
+	close(stopping)
+	close(p.lines)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline did not finish after its input closed")
+	}
+	select {
+	case n := <-batches:
+		if n != 1 {
+			t.Errorf("expected the pending event to be flushed, got batch of %d", n)
+		}
+	default:
+		t.Fatal("pending batch was not flushed on close")
+	}
+	if p.failed.Load() {
+		t.Error("expected no failed flushes")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig routes outbound requests through a proxy. Without a URL the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables apply.
+type ProxyConfig struct {
+	URL      string   `yaml:"url,omitempty"`      // http://, https:// or socks5:// proxy address
+	Username string   `yaml:"username,omitempty"` // Proxy credentials; override any in the URL
+	Password string   `yaml:"password,omitempty"`
+	NoProxy  []string `yaml:"no_proxy,omitempty"` // Hosts, domains, IPs and CIDRs reached directly
+}
+
+// proxyFunc returns the transport's Proxy function for pc.
+func proxyFunc(pc ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	if pc.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(pc.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s' (want http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy url '%s' has no host", pc.URL)
+	}
+	if pc.Username != "" {
+		u.User = url.UserPassword(pc.Username, pc.Password)
+	}
+	bypass, err := parseNoProxy(pc.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.matches(req.URL) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+// noProxyList holds the destinations that skip the proxy. Like NO_PROXY,
+// "example.com" and ".example.com" both cover example.com and its
+// subdomains, "*" covers everything, and an entry may name a port.
+type noProxyList struct {
+	all     bool
+	domains []noProxyHost
+	nets    []*net.IPNet
+}
+
+type noProxyHost struct {
+	host string
+	port string // empty matches any port
+}
+
+func parseNoProxy(entries []string) (noProxyList, error) {
+	var l noProxyList
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+		case e == "*":
+			l.all = true
+		case strings.Contains(e, "/"):
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return l, fmt.Errorf("invalid no_proxy entry '%s': %v", e, err)
+			}
+			l.nets = append(l.nets, n)
+		default:
+			h := noProxyHost{host: e}
+			if host, port, err := net.SplitHostPort(e); err == nil {
+				h = noProxyHost{host: host, port: port}
+			}
+			h.host = strings.TrimPrefix(strings.TrimPrefix(h.host, "*"), ".")
+			l.domains = append(l.domains, h)
+		}
+	}
+	return l, nil
+}
+
+// matches reports whether u is reached directly. Loopback destinations
+// always are, as with the environment variables.
+func (l noProxyList) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if l.all || host == "localhost" {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, d := range l.domains {
+		if d.port != "" && d.port != port {
+			continue
+		}
+		if host == d.host || strings.HasSuffix(host, "."+d.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedURL is s with any password masked, for logging.
+func redactedURL(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return s
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testProxy stands in for a corporate proxy. It tunnels CONNECT requests
+// and forwards absolute-form requests to backend, whatever host they name,
+// so a request only succeeds if it went through the proxy.
+type testProxy struct {
+	*httptest.Server
+	mu   sync.Mutex
+	seen []string // method and target of each request
+}
+
+func newTestProxy(t *testing.T, backend, user, pass string) *testProxy {
+	t.Helper()
+	p := &testProxy{}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user != "" && r.Header.Get("Proxy-Authorization") != want {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		p.mu.Lock()
+		if r.Method == http.MethodConnect {
+			p.seen = append(p.seen, "CONNECT "+r.Host)
+		} else {
+			p.seen = append(p.seen, r.Method+" "+r.URL.String())
+		}
+		p.mu.Unlock()
+
+		if r.Method == http.MethodConnect {
+			upstream, err := net.Dial("tcp", backend)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				upstream.Close()
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			io.Copy(conn, upstream)
+			conn.Close()
+			return
+		}
+
+		out, _ := http.NewRequest(r.Method, "http://"+backend+r.URL.RequestURI(), r.Body)
+		out.Header = r.Header.Clone()
+		out.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(out)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProxy) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.seen...)
+}
+
+func TestProxyTunnelsIngest(t *testing.T) {
+	bodies := make(chan string, 1)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer backend.Close()
+	proxy := newTestProxy(t, backend.Listener.Addr().String(), "agent", "s3cret")
+
+	useHTTPConfig(t, HTTPConfig{Proxy: ProxyConfig{URL: proxy.URL, Username: "agent", Password: "s3cret"}})
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	sharedHTTP.Load().transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	// example.com is in the test certificate and only the proxy knows where it is
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: "https://example.com/api/ingest/test"}
+	if err := shipEvents(context.Background(), stream, "token", accessLogEvents(3)); err != nil {
+		t.Fatalf("shipEvents through the proxy failed: %v", err)
+	}
+	if got := proxy.requests(); len(got) != 1 || got[0] != "CONNECT example.com:443" {
+		t.Errorf("expected one tunnel to example.com:443, got %v", got)
+	}
+	if body := <-bodies; body != string(encodeNDJSON(accessLogEvents(3))) {
+		t.Errorf("expected the batch to reach the ingest server, got %q", body)
+	}
+}
+
+func TestProxyRejectsWrongCredentials(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	proxy := newTestProxy(t, backend.Listener.Addr().String(), "agent", "s3cret")
+	useHTTPConfig(t, HTTPConfig{Proxy: ProxyConfig{URL: proxy.URL, Username: "agent", Password: "wrong"}})
+
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: "https://example.com/api/ingest/test"}
+	if err := postPayload(context.Background(), stream, "token", encodeNDJSON(accessLogEvents(1)), nil); err == nil {
+		t.Error("expected the proxy to refuse wrong credentials")
+	}
+	if got := proxy.requests(); len(got) != 0 {
+		t.Errorf("expected no request past the proxy, got %v", got)
+	}
+}
+
+func TestProxyCarriesOAuthAndDownloads(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/oauth/device/code":
+			w.Write([]byte(`{"device_code":"dev-1","user_code":"ABCD","interval":1}`))
+		case "/releases/agent.tar.gz":
+			w.Write([]byte("release"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	proxy := newTestProxy(t, backend.Listener.Addr().String(), "agent", "s3cret")
+	// Credentials in the URL work as well as separate ones
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("agent", "s3cret")
+	useHTTPConfig(t, HTTPConfig{Proxy: ProxyConfig{URL: u.String()}})
+	t.Setenv("TAILSTREAM_BASE_URL", "http://tailstream.test")
+
+	resp, err := requestDeviceCode()
+	if err != nil || resp.DeviceCode != "dev-1" {
+		t.Fatalf("expected the device code through the proxy, got %+v, %v", resp, err)
+	}
+	dest := filepath.Join(t.TempDir(), "agent.tar.gz")
+	if err := downloadFile("http://releases.test/releases/agent.tar.gz", dest); err != nil {
+		t.Fatalf("download through the proxy failed: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "release" {
+		t.Errorf("unexpected download %q", data)
+	}
+
+	want := []string{
+		"POST http://tailstream.test/api/oauth/device/code",
+		"GET http://releases.test/releases/agent.tar.gz",
+	}
+	got := proxy.requests()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("request %d: expected %q, got %q", i+1, want[i], got[i])
+		}
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	l, err := parseNoProxy([]string{"internal.example", ".corp.test", "*.svc.local", "10.0.0.0/8", "ingest.test:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url    string
+		direct bool
+	}{
+		{"https://internal.example/api", true},
+		{"https://a.internal.example/api", true},
+		{"https://notinternal.example/api", false},
+		{"https://corp.test/", true},
+		{"https://logs.corp.test/", true},
+		{"http://api.svc.local/", true},
+		{"https://10.1.2.3/", true},
+		{"https://11.1.2.3/", false},
+		{"https://ingest.test:8443/", true},
+		{"https://ingest.test/", false},
+		{"http://localhost:8080/", true},
+		{"http://127.0.0.1:8080/", true},
+		{"https://app.tailstream.io/api/ingest/x", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := l.matches(u); got != tt.direct {
+			t.Errorf("%s: direct = %v, want %v", tt.url, got, tt.direct)
+		}
+	}
+
+	all, _ := parseNoProxy([]string{"*"})
+	if u, _ := url.Parse("https://app.tailstream.io/"); !all.matches(u) {
+		t.Error("expected * to bypass the proxy for every host")
+	}
+}
+
+func TestProxyFuncHonoursNoProxy(t *testing.T) {
+	proxy, err := proxyFunc(ProxyConfig{URL: "http://proxy.corp:3128", NoProxy: []string{"corp.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, _ := http.NewRequest("GET", "https://ingest.corp.test/", nil)
+	if u, _ := proxy(direct); u != nil {
+		t.Errorf("expected a no_proxy host to be reached directly, got %v", u)
+	}
+	remote, _ := http.NewRequest("GET", "https://app.tailstream.io/", nil)
+	if u, _ := proxy(remote); u == nil || u.Host != "proxy.corp:3128" {
+		t.Errorf("expected other hosts to use the proxy, got %v", u)
+	}
+}
+
+func TestProxyConfigInvalid(t *testing.T) {
+	for _, pc := range []ProxyConfig{
+		{URL: "ftp://proxy.corp:21"},
+		{URL: "http://"},
+		{URL: "http://proxy.corp:3128", NoProxy: []string{"10.0.0.0/99"}},
+	} {
+		if _, err := proxyFunc(pc); err == nil {
+			t.Errorf("expected %+v to be rejected", pc)
+		}
+	}
+}
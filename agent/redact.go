@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Redaction modes.
+const (
+	redactMask = "mask" // replace the value with redactedText
+	redactHash = "hash" // replace the value with a keyed HMAC, so equal values stay correlated
+	redactDrop = "drop" // remove the value, or the whole field that holds it
+)
+
+const redactedText = "[REDACTED]"
+
+// RedactConfig removes sensitive data from events before they leave the host.
+type RedactConfig struct {
+	Detectors []string     `yaml:"detectors,omitempty"` // Built-in detectors to apply, or "all"
+	Custom    []RedactRule `yaml:"custom,omitempty"`    // Additional patterns
+	Mode      string       `yaml:"mode,omitempty"`      // mask (default), hash or drop
+	HashKey   string       `yaml:"hash_key,omitempty"`  // Secret key for hash mode
+}
+
+// RedactRule is a custom redaction pattern. When Pattern has a group, only
+// the text of the first group is redacted.
+type RedactRule struct {
+	Name    string `yaml:"name,omitempty"`
+	Pattern string `yaml:"pattern"`
+	Mode    string `yaml:"mode,omitempty"` // Overrides the stream's mode for this rule
+}
+
+func (c RedactConfig) enabled() bool {
+	return len(c.Detectors) > 0 || len(c.Custom) > 0
+}
+
+// detector is a built-in redaction rule. valid, if set, confirms a match.
+type detector struct {
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// detectors are the built-in rules by name. Their first group, if any,
+// holds the sensitive part of the match.
+var detectors = map[string]detector{
+	"bearer_token":  {re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`)},
+	"secret_params": {re: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|token|access_token|refresh_token|id_token|api_key|apikey|secret|client_secret)=([^&\s"';]+)`)},
+	"email":         {re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)},
+	"ipv4":          {re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`)},
+	"ipv6":          {re: regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|(?:\d{1,3}\.){3}\d{1,3})`), valid: validIPv6},
+	// Card numbers start with 2 to 6; this keeps epoch milliseconds out
+	"card_number": {re: regexp.MustCompile(`\b[2-6](?:[ -]?\d){12,18}\b`), valid: luhn},
+}
+
+// validIPv6 rejects candidates such as clock times that are not addresses.
+func validIPv6(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && strings.Contains(s, ":")
+}
+
+// luhn reports whether the digits in s pass the Luhn check used by card numbers.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
+
+type redactRule struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(string) bool
+	mode  string
+}
+
+// redactor applies a stream's redaction rules to events.
+type redactor struct {
+	rules []redactRule
+	key   []byte
+}
+
+func validRedactMode(mode string) bool {
+	switch mode {
+	case redactMask, redactHash, redactDrop:
+		return true
+	}
+	return false
+}
+
+// newRedactor returns nil when cfg enables no rules. Any invalid setting is
+// an error: a stream must not ship data its owner asked to redact.
+func newRedactor(cfg RedactConfig) (*redactor, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	mode := cfg.Mode
+	if mode == "" {
+		mode = redactMask
+	}
+	if !validRedactMode(mode) {
+		return nil, fmt.Errorf("mode must be %s, %s or %s, got %q", redactMask, redactHash, redactDrop, mode)
+	}
+
+	r := &redactor{key: []byte(cfg.HashKey)}
+	for _, name := range cfg.Detectors {
+		if name == "all" {
+			for _, name := range []string{"bearer_token", "secret_params", "email", "ipv6", "ipv4", "card_number"} {
+				d := detectors[name]
+				r.rules = append(r.rules, redactRule{name: name, re: d.re, valid: d.valid, mode: mode})
+			}
+			continue
+		}
+		d, ok := detectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+		r.rules = append(r.rules, redactRule{name: name, re: d.re, valid: d.valid, mode: mode})
+	}
+	for i, c := range cfg.Custom {
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil || c.Pattern == "" {
+			return nil, fmt.Errorf("custom rule %d: invalid pattern %q", i+1, c.Pattern)
+		}
+		ruleMode := c.Mode
+		if ruleMode == "" {
+			ruleMode = mode
+		}
+		if !validRedactMode(ruleMode) {
+			return nil, fmt.Errorf("custom rule %d: mode must be %s, %s or %s, got %q", i+1, redactMask, redactHash, redactDrop, ruleMode)
+		}
+		r.rules = append(r.rules, redactRule{name: c.Name, re: re, mode: ruleMode})
+	}
+
+	for _, rule := range r.rules {
+		if rule.mode == redactHash && len(r.key) == 0 {
+			return nil, fmt.Errorf("hash mode needs a hash_key")
+		}
+	}
+	return r, nil
+}
+
+// text redacts every match in s. It also reports whether a drop rule
+// matched, in which case a field holding s should be removed altogether.
+func (r *redactor) text(s string) (string, bool) {
+	drop := false
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) > 2 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if rule.valid != nil && !rule.valid(s[start:end]) {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(r.replacement(rule.mode, s[start:end]))
+			last = end
+			if rule.mode == redactDrop {
+				drop = true
+			}
+		}
+		if last > 0 {
+			b.WriteString(s[last:])
+			s = b.String()
+		}
+	}
+	return s, drop
+}
+
+func (r *redactor) replacement(mode, value string) string {
+	switch mode {
+	case redactHash:
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(value))
+		return "[hmac:" + hex.EncodeToString(mac.Sum(nil)[:8]) + "]"
+	case redactDrop:
+		return ""
+	}
+	return redactedText
+}
+
+// event redacts the raw line and every parsed string value of ev.
+func (r *redactor) event(ev Event) Event {
+	switch e := ev.(type) {
+	case LogEvent:
+		e.Log, _ = r.text(e.Log)
+		if e.Fields != nil {
+			f := *e.Fields
+			for _, s := range []*string{&f.RemoteAddr, &f.Method, &f.Path, &f.Protocol, &f.Referer, &f.UserAgent} {
+				if v, drop := r.text(*s); drop {
+					*s = ""
+				} else {
+					*s = v
+				}
+			}
+			e.Fields = &f
+		}
+		return e
+	case JSONEvent:
+		for k, raw := range e.Object {
+			v, changed, drop := r.json(raw)
+			switch {
+			case drop:
+				delete(e.Object, k)
+			case changed:
+				e.Object[k] = v
+			}
+		}
+		return e
+	}
+	return ev
+}
+
+// json redacts a JSON value. Objects and arrays are redacted recursively;
+// fields and elements that a drop rule matches are removed.
+func (r *redactor) json(raw json.RawMessage) (json.RawMessage, bool, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return raw, false, false
+	}
+	v, changed, drop := r.value(v)
+	if drop || !changed {
+		return raw, false, drop
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return raw, false, false
+	}
+	return out, true, false
+}
+
+func (r *redactor) value(v interface{}) (interface{}, bool, bool) {
+	switch x := v.(type) {
+	case string:
+		s, drop := r.text(x)
+		return s, s != x, drop
+	case json.Number:
+		// Card numbers are often logged as plain numbers
+		s, drop := r.text(x.String())
+		if s == x.String() {
+			return x, false, drop
+		}
+		return s, true, drop
+	case map[string]interface{}:
+		changed := false
+		for k, e := range x {
+			nv, c, drop := r.value(e)
+			switch {
+			case drop:
+				delete(x, k)
+				changed = true
+			case c:
+				x[k] = nv
+				changed = true
+			}
+		}
+		return x, changed, false
+	case []interface{}:
+		changed := false
+		kept := x[:0]
+		for _, e := range x {
+			nv, c, drop := r.value(e)
+			if drop {
+				changed = true
+				continue
+			}
+			changed = changed || c
+			kept = append(kept, nv)
+		}
+		return kept, changed, false
+	}
+	return v, false, false
+}
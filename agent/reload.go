@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// configPollInterval is how often the config file is checked when change
+	// notifications are unavailable, and as a safety net when they are
+	configPollInterval = 5 * time.Second
+	// configSettle is how long a change notification waits for the writer
+	// to finish before the file is checked
+	configSettle = 500 * time.Millisecond
+)
+
+// runningStream is a stream's pipeline together with its spool.
+type runningStream struct {
+	cfg        StreamConfig
+	pipeline   *streamPipeline
+	spool      *Spool
+	stopReplay context.CancelFunc
+	replayed   chan struct{} // closed once the spool replay has stopped
+	done       chan struct{} // closed once the pipeline has flushed
+}
+
+// supervisor runs a pipeline for every configured stream. On SIGHUP or when
+// the config file changes it reads the file again and restarts only the
+// streams whose settings changed; an invalid file leaves everything as it is.
+type supervisor struct {
+	ctx      context.Context // ends when shutdown begins
+	shipCtx  context.Context
+	stateDir string
+	reg      *Registry
+	tailers  *tailerSet
+
+	mu      sync.Mutex
+	cfg     Config
+	streams map[string]*runningStream
+	started []*runningStream // every stream started, including replaced ones
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newSupervisor(ctx, shipCtx context.Context, cfg Config, stateDir string, reg *Registry) *supervisor {
+	return &supervisor{
+		ctx:      ctx,
+		shipCtx:  shipCtx,
+		stateDir: stateDir,
+		reg:      reg,
+		cfg:      cfg,
+		streams:  make(map[string]*runningStream),
+	}
+}
+
+// config returns the config currently applied.
+func (sv *supervisor) config() Config {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.cfg
+}
+
+// startStream opens the spool of stream, starts replaying it and starts the
+// stream's pipeline. It returns nil once shutdown has begun.
+func (sv *supervisor) startStream(cfg Config, stream StreamConfig) *runningStream {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.closed {
+		return nil
+	}
+
+	rs := &runningStream{cfg: stream, replayed: make(chan struct{}), done: make(chan struct{})}
+	rs.spool = openStreamSpool(cfg, sv.stateDir, stream)
+	replayCtx, cancel := context.WithCancel(sv.ctx)
+	rs.stopReplay = cancel
+	if rs.spool != nil {
+		go func() {
+			defer close(rs.replayed)
+			replaySpool(replayCtx, stream, rs.spool)
+		}()
+	} else {
+		close(rs.replayed)
+	}
+
+	rs.pipeline = newPipeline(stream, rs.spool, sv.reg)
+	sv.wg.Add(1)
+	go func() {
+		defer sv.wg.Done()
+		defer close(rs.done)
+		rs.pipeline.run(sv.shipCtx, sv.ctx.Done())
+	}()
+
+	sv.streams[stream.Name] = rs
+	sv.started = append(sv.started, rs)
+	return rs
+}
+
+// stopStream waits for a stream whose input was closed to flush, then stops
+// its spool replay and closes the spool, so a successor can open it again.
+func (sv *supervisor) stopStream(rs *runningStream) {
+	<-rs.done
+	rs.stopReplay()
+	<-rs.replayed
+	if rs.spool != nil {
+		rs.spool.Close()
+	}
+	sv.mu.Lock()
+	if sv.streams[rs.cfg.Name] == rs {
+		delete(sv.streams, rs.cfg.Name)
+	}
+	sv.mu.Unlock()
+}
+
+func (sv *supervisor) pipelines() []*streamPipeline {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	var ps []*streamPipeline
+	for _, rs := range sv.streams {
+		ps = append(ps, rs.pipeline)
+	}
+	return ps
+}
+
+// shutdown waits for every pipeline to flush, once the tailers have stopped
+// and closed their input, and closes the spools. It reports whether some
+// events could neither be shipped nor spooled.
+func (sv *supervisor) shutdown() (failed bool) {
+	sv.mu.Lock()
+	sv.closed = true
+	sv.mu.Unlock()
+	sv.wg.Wait()
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	for _, rs := range sv.started {
+		if rs.pipeline.failed.Load() {
+			failed = true
+		}
+	}
+	for _, rs := range sv.streams {
+		<-rs.replayed
+		if rs.spool != nil {
+			rs.spool.Close()
+		}
+	}
+	return failed
+}
+
+// watch reloads the config file at path on SIGHUP and whenever it changes,
+// until shutdown begins.
+func (sv *supervisor) watch(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	changed := make(chan struct{}, 1)
+	if path != "" {
+		go watchConfigFile(sv.ctx, path, changed)
+	}
+	for {
+		select {
+		case <-sv.ctx.Done():
+			return
+		case <-hup:
+			log.Printf("RELOAD: SIGHUP received, reloading %s", path)
+		case <-changed:
+			log.Printf("RELOAD: %s changed, reloading", path)
+		}
+		sv.reload(path)
+	}
+}
+
+// reload reads and checks the config file and applies it. The agent keeps
+// running on the current config when the file cannot be read or is invalid.
+func (sv *supervisor) reload(path string) {
+	next, err := readConfig(path)
+	if err == nil {
+		err = validateConfig(next)
+	}
+	if err != nil {
+		log.Printf("ERROR: Cannot reload %s: %v - keeping the current config", path, err)
+		return
+	}
+	if reflect.DeepEqual(next, sv.config()) {
+		log.Printf("RELOAD: No changes in %s", path)
+		return
+	}
+	sv.apply(next)
+}
+
+// apply moves the agent from the current config to next. Streams whose
+// settings are unchanged keep running untouched. A changed stream is
+// stopped and flushed before its replacement starts, and the new tailers
+// continue where the old ones left off, so nothing is lost or shipped twice.
+func (sv *supervisor) apply(next Config) {
+	cur := sv.config()
+
+	if !reflect.DeepEqual(cur.HTTP, next.HTTP) {
+		if err := configureHTTP(next.HTTP); err != nil {
+			log.Printf("ERROR: Invalid http settings: %v - keeping the current ones", err)
+		}
+	}
+	if cur.Hostname != next.Hostname || cur.Env != next.Env || !reflect.DeepEqual(cur.Labels, next.Labels) {
+		setAgentMetadata(next)
+	}
+	if cur.StateDir != next.StateDir || !reflect.DeepEqual(cur.Updates, next.Updates) {
+		log.Printf("WARNING: Changes to state_dir and updates take effect after a restart")
+	}
+
+	// Streams share the spool settings, so a change there restarts them all
+	spoolChanged := !reflect.DeepEqual(cur.Spool, next.Spool)
+
+	sv.mu.Lock()
+	var kept []*streamPipeline
+	var stopped []*runningStream
+	var starting []StreamConfig
+	var added, changed int
+	names := make(map[string]bool)
+	for _, stream := range next.Streams {
+		names[stream.Name] = true
+		rs, ok := sv.streams[stream.Name]
+		switch {
+		case !ok:
+			added++
+			starting = append(starting, stream)
+		case spoolChanged || !reflect.DeepEqual(rs.cfg, stream):
+			changed++
+			stopped = append(stopped, rs)
+			starting = append(starting, stream)
+		default:
+			kept = append(kept, rs.pipeline)
+		}
+	}
+	for name, rs := range sv.streams {
+		if !names[name] {
+			stopped = append(stopped, rs)
+		}
+	}
+	sv.mu.Unlock()
+
+	// Stop the tailers of changed and removed streams and let their
+	// pipelines flush; the checkpoints are then up to date for the new ones
+	if len(stopped) > 0 {
+		if !sv.tailers.update(sv.ctx, next, kept) {
+			return
+		}
+		for _, rs := range stopped {
+			sv.stopStream(rs)
+		}
+	}
+
+	var fresh []*streamPipeline
+	abort := func() {
+		// Shutting down before the tailers took the new pipelines over
+		for _, p := range fresh {
+			close(p.lines)
+		}
+	}
+	for _, stream := range starting {
+		checkPaths(stream)
+		rs := sv.startStream(next, stream)
+		if rs == nil {
+			abort()
+			return
+		}
+		fresh = append(fresh, rs.pipeline)
+	}
+	if !sv.tailers.update(sv.ctx, next, append(kept, fresh...)) {
+		abort()
+		return
+	}
+
+	sv.mu.Lock()
+	sv.cfg = next
+	sv.mu.Unlock()
+	log.Printf("RELOAD: Config applied: %d streams added, %d changed, %d removed, %d unchanged",
+		added, changed, len(stopped)-changed, len(kept))
+}
+
+// validateConfig rejects a config the agent cannot run as written, so a
+// reload keeps the current config rather than apply it. At startup only
+// validateRequired is fatal; the agent runs streams with other invalid
+// settings degraded, as it always has, and logs an ERROR for each.
+func validateConfig(cfg Config) error {
+	if err := validateRequired(cfg); err != nil {
+		return err
+	}
+	for _, stream := range cfg.Streams {
+		if err := validateStream(stream); err != nil {
+			return fmt.Errorf("invalid settings for stream '%s': %v", stream.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateRequired rejects the settings run refuses to start with.
+func validateRequired(cfg Config) error {
+	if len(cfg.Streams) == 0 {
+		return errors.New("no streams configured")
+	}
+	if _, err := newTLSClientConfig(cfg.HTTP.TLS); err != nil {
+		return fmt.Errorf("invalid http.tls settings: %v", err)
+	}
+	for _, stream := range cfg.Streams {
+		if _, err := newLineFilter(stream); err != nil {
+			return fmt.Errorf("invalid filters for stream '%s': %v", stream.Name, err)
+		}
+		if _, err := newRedactor(stream.Redact); err != nil {
+			return fmt.Errorf("invalid redact settings for stream '%s': %v", stream.Name, err)
+		}
+		if !stream.TLS.isZero() {
+			if _, err := newTLSClientConfig(cfg.HTTP.TLS.merge(stream.TLS)); err != nil {
+				return fmt.Errorf("invalid TLS settings for stream '%s': %v", stream.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateStream rejects the settings that would leave a stream running
+// degraded: lines left unjoined or unparsed, events without their time, or
+// paths skipped.
+func validateStream(stream StreamConfig) error {
+	if stream.Multiline.enabled() {
+		if _, err := newAssembler(stream.Multiline); err != nil {
+			return fmt.Errorf("invalid multiline rule: %v", err)
+		}
+	}
+	if !validFormat(stream.Format) {
+		return fmt.Errorf("unknown format '%s'", stream.Format)
+	}
+	if stream.Timestamp.enabled() {
+		if _, err := newTimestampExtractor(stream.Timestamp); err != nil {
+			return fmt.Errorf("invalid timestamp rule: %v", err)
+		}
+	}
+	if !validCompression(stream.Compression) {
+		return fmt.Errorf("unknown compression '%s'", stream.Compression)
+	}
+	if err := stream.Limits.Sampling.check(stream.Format); err != nil {
+		return fmt.Errorf("invalid sampling: %v", err)
+	}
+	for _, path := range stream.Paths {
+		if _, err := compilePathPattern(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configStamp identifies a version of the config file.
+type configStamp struct {
+	exists   bool
+	size     int64
+	modTime  time.Time
+	dev, ino uint64
+}
+
+func statConfig(path string) configStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return configStamp{}
+	}
+	dev, ino := fileIdentity(fi)
+	return configStamp{exists: true, size: fi.Size(), modTime: fi.ModTime(), dev: dev, ino: ino}
+}
+
+// watchConfigFile signals changed whenever the file at path is written,
+// replaced or removed, until ctx ends. Editors and config management often
+// write a new file and rename it over the old one, which is caught too.
+func watchConfigFile(ctx context.Context, path string, changed chan<- struct{}) {
+	last := statConfig(path)
+
+	var events <-chan struct{}
+	if w, err := newFileWatcher(path); err == nil {
+		defer w.Close()
+		events = w.Events()
+	} else if !errors.Is(err, errWatchUnsupported) {
+		// Most likely the inotify limits (fs.inotify.max_user_instances and
+		// max_user_watches) are used up
+		log.Printf("WARNING: Cannot watch %s for changes, polling instead: %v", path, err)
+	} else if os.Getenv("DEBUG") == "1" {
+		log.Printf("Polling %s for changes: %v", path, err)
+	}
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+	settle := time.NewTimer(configSettle)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			} else {
+				settle.Reset(configSettle)
+			}
+			continue
+		case <-settle.C:
+		case <-poll.C:
+		}
+		if stamp := statConfig(path); stamp != last {
+			last = stamp
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := readConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+
+	broken := filepath.Join(dir, "broken.yaml")
+	os.WriteFile(broken, []byte("streams:\n  - name: [unterminated\n"), 0o644)
+	if _, err := readConfig(broken); err == nil {
+		t.Error("expected an error for invalid YAML")
+	}
+
+	good := filepath.Join(dir, "agent.yaml")
+	os.WriteFile(good, []byte("env: staging\nstreams:\n  - name: app\n    key: k\n    paths: ['/var/log/app.log']\n"), 0o644)
+	cfg, err := readConfig(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Env != "staging" || len(cfg.Streams) != 1 || cfg.Streams[0].Name != "app" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.ShutdownTimeout != defaultConfig().ShutdownTimeout {
+		t.Errorf("expected the defaults to apply, got shutdown_timeout %v", cfg.ShutdownTimeout)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	stream := StreamConfig{Name: "app", Paths: []string{"/var/log/app.log"}}
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"valid", Config{Streams: []StreamConfig{stream}}, true},
+		{"no streams", Config{}, false},
+		{"bad filter", Config{Streams: []StreamConfig{{Name: "app", Filters: []FilterRule{{Action: "discard", Pattern: "x"}}}}}, false},
+		{"bad redaction", Config{Streams: []StreamConfig{{Name: "app", Redact: RedactConfig{Detectors: []string{"passport"}}}}}, false},
+		{"bad global tls", Config{HTTP: HTTPConfig{TLS: TLSConfig{MinVersion: "1.0"}}, Streams: []StreamConfig{stream}}, false},
+		{"bad stream tls", Config{Streams: []StreamConfig{{Name: "app", TLS: TLSConfig{CAFile: "/nonexistent/ca.pem"}}}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateConfig(tt.cfg); (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tt.name, tt.ok, err)
+		}
+	}
+
+	// A reload is refused on settings the agent still starts with, running
+	// the stream degraded
+	degraded := map[string]StreamConfig{
+		"bad multiline":   {Name: "app", Multiline: MultilineConfig{Start: "("}},
+		"unknown format":  {Name: "app", Format: "syslog"},
+		"bad timestamp":   {Name: "app", Timestamp: TimestampConfig{Pattern: "^(\\S+)", Timezone: "Mars/Olympus"}},
+		"bad compression": {Name: "app", Compression: "zstd"},
+		"bad sampling":    {Name: "app", Limits: LimitsConfig{Sampling: SamplingConfig{Rate: 0.5, Mode: "reservoir"}}},
+		"malformed path":  {Name: "app", Paths: []string{"/var/log/{site}/{site}.log"}},
+	}
+	for name, s := range degraded {
+		cfg := Config{Streams: []StreamConfig{s}}
+		if err := validateConfig(cfg); err == nil {
+			t.Errorf("%s: expected the reload to be refused", name)
+		}
+		if err := validateRequired(cfg); err != nil {
+			t.Errorf("%s: expected the agent to still start, got %v", name, err)
+		}
+	}
+}
+
+func TestWatchConfigFileSeesReplacement(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.yaml")
+	os.WriteFile(path, []byte("env: one\n"), 0o644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go watchConfigFile(ctx, path, changed)
+	time.Sleep(100 * time.Millisecond)
+
+	// Written next to the config and renamed over it, as editors do
+	tmp := filepath.Join(dir, ".agent.yaml.tmp")
+	os.WriteFile(tmp, []byte("env: two\n"), 0o644)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(configPollInterval + time.Second):
+		t.Fatal("replacing the config file went unnoticed")
+	}
+
+	select {
+	case <-changed:
+		t.Error("expected a single notification for a single change")
+	case <-time.After(2 * configSettle):
+	}
+}
+
+// syncBuffer collects the agent's output while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestReloadRestartsChangedStreams runs the agent and reloads its config:
+// an unchanged stream keeps going, a changed one ships with its new key
+// without losing or repeating a line, a removed one stops and a new one
+// starts. A broken config is refused and the running one stays in place.
+func TestReloadRestartsChangedStreams(t *testing.T) {
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "tailstream-agent")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build failed: %v\n%s", err, out)
+	}
+
+	var mu sync.Mutex
+	received := make(map[string][]string) // log line -> keys it was shipped with
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		mu.Lock()
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var ev LogEvent
+			if json.Unmarshal(line, &ev) == nil {
+				received[ev.Log] = append(received[ev.Log], key)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	shipped := func(line string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[line]
+	}
+
+	files := make(map[string]string)
+	for _, name := range []string{"kept", "changed", "removed", "added"} {
+		files[name] = filepath.Join(tmp, name+".log")
+		if err := os.WriteFile(files[name], nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgFile := filepath.Join(tmp, "agent.yaml")
+	writeConfig := func(streams map[string]string) {
+		var b strings.Builder
+		b.WriteString("updates:\n  enabled: false\nstreams:\n")
+		for _, name := range []string{"kept", "changed", "removed", "added"} {
+			if key, ok := streams[name]; ok {
+				fmt.Fprintf(&b, "  - name: %s\n    stream_id: %s\n    url: '%s'\n    key: %s\n    paths: ['%s']\n", name, name, srv.URL, key, files[name])
+			}
+		}
+		// Replace the file in one step so the agent never reads half of it
+		next := cfgFile + ".tmp"
+		if err := os.WriteFile(next, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(next, cfgFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(map[string]string{"kept": "k1", "changed": "c1", "removed": "r1"})
+
+	cmd := exec.Command(bin, "run", "--config", cfgFile)
+	cmd.Env = append(os.Environ(), "TAILSTREAM_DISABLE_UPDATES=1", "TAILSTREAM_STATE_DIR="+filepath.Join(tmp, "state"))
+	out := &syncBuffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start agent: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s\n%s", what, out.String())
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitForOutput := func(s string, n int) {
+		t.Helper()
+		waitFor(fmt.Sprintf("%q in the output", s), func() bool { return strings.Count(out.String(), s) >= n })
+	}
+
+	time.Sleep(time.Second)
+	appendFile(t, files["kept"], "kept 1\n")
+	appendFile(t, files["changed"], "changed 1\n")
+	appendFile(t, files["removed"], "removed 1\n")
+	for _, line := range []string{"kept 1", "changed 1", "removed 1"} {
+		waitFor(line, func() bool { return len(shipped(line)) > 0 })
+	}
+
+	// Written while the reload is under way, so it must reach the new stream
+	appendFile(t, files["changed"], "changed 2\n")
+	writeConfig(map[string]string{"kept": "k1", "changed": "c2", "added": "a1"})
+	waitForOutput("RELOAD: Config applied: 1 streams added, 1 changed, 1 removed, 1 unchanged", 1)
+
+	appendFile(t, files["kept"], "kept 2\n")
+	appendFile(t, files["changed"], "changed 3\n")
+	appendFile(t, files["removed"], "removed 2\n")
+	appendFile(t, files["added"], "added 1\n")
+	for _, line := range []string{"kept 2", "changed 3", "added 1"} {
+		waitFor(line, func() bool { return len(shipped(line)) > 0 })
+	}
+
+	// An invalid config is refused and the agent carries on with the last good one
+	if err := os.WriteFile(cfgFile, []byte("streams: [unterminated\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitForOutput("ERROR: Cannot reload", 1)
+	// So is one that would leave a stream running without its multiline rule
+	badMultiline := fmt.Sprintf("updates:\n  enabled: false\nstreams:\n  - name: changed\n    stream_id: changed\n    url: '%s'\n    key: c3\n    paths: ['%s']\n    multiline:\n      start: '('\n", srv.URL, files["changed"])
+	if err := os.WriteFile(cfgFile, []byte(badMultiline), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitForOutput("ERROR: Cannot reload", 2)
+	appendFile(t, files["changed"], "changed 4\n")
+	waitFor("changed 4", func() bool { return len(shipped("changed 4")) > 0 })
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean exit, got %v\n%s", err, out.String())
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("agent did not exit after SIGTERM:\n%s", out.String())
+	}
+
+	want := map[string]string{
+		"kept 1":    "k1",
+		"kept 2":    "k1",
+		"changed 1": "c1",
+		"changed 3": "c2",
+		"changed 4": "c2",
+		"removed 1": "r1",
+		"added 1":   "a1",
+	}
+	for line, key := range want {
+		if got := shipped(line); len(got) != 1 || got[0] != key {
+			t.Errorf("%q: expected to be shipped once with key %s, got %v", line, key, got)
+		}
+	}
+	// Read by either the old or the new stream, but exactly once
+	if got := shipped("changed 2"); len(got) != 1 {
+		t.Errorf("expected 'changed 2' to be shipped once across the reload, got %v", got)
+	}
+	if got := shipped("removed 2"); len(got) != 0 {
+		t.Errorf("expected the removed stream to stop shipping, got %v", got)
+	}
+}
+
+// TestSupervisorReloadWithoutRegistry restarts a changed stream when no
+// state directory is usable, so the new tailers have only the positions
+// handed over by the old ones to continue from.
+func TestSupervisorReloadWithoutRegistry(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var ev LogEvent
+			if json.Unmarshal(line, &ev) == nil {
+				received = append(received, ev.Log)
+			}
+		}
+	}))
+	defer srv.Close()
+	shipped := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+	waitForLines := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(shipped()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d lines, got %q", n, shipped())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stream := StreamConfig{Name: "app", StreamID: "app", URL: srv.URL, Key: "k1", Paths: []string{file}, Batch: BatchConfig{Linger: 50 * time.Millisecond}}
+	var cfg Config
+	cfg.Discovery.RescanInterval = time.Hour
+	cfg.Streams = []StreamConfig{stream}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sv := newSupervisor(ctx, context.Background(), cfg, "", nil)
+	sv.startStream(cfg, stream)
+	sv.tailers = newTailerSet(cfg, nil, sv.pipelines())
+	go sv.tailers.run(ctx)
+	defer func() {
+		cancel()
+		sv.shutdown()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, file, "one\n")
+	waitForLines(1)
+
+	next := cfg
+	next.Streams = []StreamConfig{stream}
+	next.Streams[0].Key = "k2"
+	// Written before the reload and not read yet, so only the new stream can ship it
+	appendFile(t, file, "two\n")
+	sv.apply(next)
+	appendFile(t, file, "three\n")
+	waitForLines(3)
+
+	time.Sleep(200 * time.Millisecond)
+	if got := shipped(); len(got) != 3 || got[0] != "one" || got[1] != "two" || got[2] != "three" {
+		t.Errorf("expected every line once across the reload, got %q", got)
+	}
+}
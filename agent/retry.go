@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryConfig is the delivery policy for a stream. Zero fields use the defaults below.
+type RetryConfig struct {
+	InitialInterval time.Duration `yaml:"initial_interval,omitempty"` // Delay before the first retry
+	MaxInterval     time.Duration `yaml:"max_interval,omitempty"`     // Upper bound for a single delay
+	Multiplier      float64       `yaml:"multiplier,omitempty"`       // Growth factor between attempts
+	Jitter          float64       `yaml:"jitter,omitempty"`           // Random spread, as a fraction of the delay (0-1)
+	MaxElapsed      time.Duration `yaml:"max_elapsed,omitempty"`      // Total time spent retrying one batch
+}
+
+const (
+	defaultRetryInitialInterval = 500 * time.Millisecond
+	defaultRetryMaxInterval     = 30 * time.Second
+	defaultRetryMultiplier      = 2.0
+	defaultRetryJitter          = 0.2
+	defaultRetryMaxElapsed      = 60 * time.Second
+)
+
+// withDefaults fills unset fields with the default policy.
+func (rc RetryConfig) withDefaults() RetryConfig {
+	if rc.InitialInterval <= 0 {
+		rc.InitialInterval = defaultRetryInitialInterval
+	}
+	if rc.MaxInterval <= 0 {
+		rc.MaxInterval = defaultRetryMaxInterval
+	}
+	if rc.Multiplier < 1 {
+		rc.Multiplier = defaultRetryMultiplier
+	}
+	if rc.Jitter <= 0 || rc.Jitter > 1 {
+		rc.Jitter = defaultRetryJitter
+	}
+	if rc.MaxElapsed <= 0 {
+		rc.MaxElapsed = defaultRetryMaxElapsed
+	}
+	return rc
+}
+
+// backoff produces exponentially growing, jittered delays.
+type backoff struct {
+	cfg     RetryConfig
+	attempt int
+}
+
+func newBackoff(cfg RetryConfig) *backoff {
+	return &backoff{cfg: cfg.withDefaults()}
+}
+
+// next returns the delay before the next attempt.
+func (b *backoff) next() time.Duration {
+	d := float64(b.cfg.InitialInterval)
+	for i := 0; i < b.attempt && d < float64(b.cfg.MaxInterval); i++ {
+		d *= b.cfg.Multiplier
+	}
+	if d > float64(b.cfg.MaxInterval) {
+		d = float64(b.cfg.MaxInterval)
+	}
+	b.attempt++
+
+	// Spread retries from many agents so they do not hit the endpoint in lockstep
+	d += d * b.cfg.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// shipError describes a non-2xx response from the ingest endpoint.
+type shipError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *shipError) Error() string {
+	return fmt.Sprintf("ship: %s - %s", e.Status, e.Body)
+}
+
+// retryable reports whether the same request may succeed if sent again.
+func (e *shipError) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// rejected reports whether the endpoint refused the payload itself, so it can
+// never be delivered. Auth failures are not rejections: fixing the key makes
+// the same payload deliverable, so those batches are still worth spooling.
+func (e *shipError) rejected() bool {
+	if e.retryable() {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// isRetryable classifies a delivery error. Transport errors are retryable;
+// HTTP errors depend on the status code. Anything else (such as a stream
+// without an ID) would fail the same way again.
+func isRetryable(err error) bool {
+	var se *shipError
+	if errors.As(err, &se) {
+		return se.retryable()
+	}
+	var ue *url.Error
+	return errors.As(err, &ue) && !errors.Is(err, context.Canceled)
+}
+
+// isRejected reports whether err means the payload will never be accepted.
+func isRejected(err error) bool {
+	var se *shipError
+	return errors.As(err, &se) && se.rejected()
+}
+
+// retryAfter returns the server-requested delay carried by err, if any.
+func retryAfter(err error) time.Duration {
+	var se *shipError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// postWithRetry sends payload using the stream's retry policy. Retryable
+// failures are retried with exponential backoff and jitter, honoring
+// Retry-After on 429 and 503, until the policy's MaxElapsed budget is spent.
+func postWithRetry(ctx context.Context, stream StreamConfig, globalKey string, payload []byte, meta *batchMetadata) error {
+	policy := stream.Retry.withDefaults()
+	b := newBackoff(policy)
+	deadline := time.Now().Add(policy.MaxElapsed)
+
+	for attempt := 1; ; attempt++ {
+		err := postPayload(ctx, stream, globalKey, payload, meta)
+		if err == nil || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := b.next()
+		if ra := retryAfter(err); ra > 0 {
+			delay = ra
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("ship to stream '%s' failed (attempt %d), retrying in %v: %v", stream.Name, attempt, delay.Round(time.Millisecond), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedServer replies with the given status codes in order, then 200 for
+// every further request. It returns the server and a request counter.
+func scriptedServer(t *testing.T, statuses []int, headers map[string]string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(statuses) {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func fastRetry() RetryConfig {
+	return RetryConfig{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+		MaxElapsed:      2 * time.Second,
+	}
+}
+
+func TestPostWithRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		headers     map[string]string
+		retry       RetryConfig
+		expectError bool
+		expectCalls int32
+	}{
+		{
+			name:        "retries transient server errors",
+			statuses:    []int{503, 502, 500},
+			retry:       fastRetry(),
+			expectCalls: 4,
+		},
+		{
+			name:        "retries rate limiting",
+			statuses:    []int{429},
+			retry:       fastRetry(),
+			expectCalls: 2,
+		},
+		{
+			name:        "bad request is permanent",
+			statuses:    []int{400},
+			retry:       fastRetry(),
+			expectError: true,
+			expectCalls: 1,
+		},
+		{
+			name:        "unauthorized is not retried",
+			statuses:    []int{401},
+			retry:       fastRetry(),
+			expectError: true,
+			expectCalls: 1,
+		},
+		{
+			name:     "gives up when retry budget is spent",
+			statuses: []int{503, 503, 503, 503, 503, 503, 503, 503, 503, 503},
+			retry: RetryConfig{
+				InitialInterval: 40 * time.Millisecond,
+				MaxInterval:     40 * time.Millisecond,
+				MaxElapsed:      100 * time.Millisecond,
+			},
+			expectError: true,
+			expectCalls: 3,
+		},
+		{
+			name:        "Retry-After beyond budget stops retrying",
+			statuses:    []int{503},
+			headers:     map[string]string{"Retry-After": "120"},
+			retry:       fastRetry(),
+			expectError: true,
+			expectCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := scriptedServer(t, tt.statuses, tt.headers)
+			stream := StreamConfig{Name: "test", StreamID: "test", URL: srv.URL, Retry: tt.retry}
+
+			err := postWithRetry(context.Background(), stream, "", []byte("\"line\"\n"), nil)
+			if tt.expectError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("expected success, got %v", err)
+			}
+			if got := calls.Load(); got != tt.expectCalls {
+				t.Errorf("expected %d requests, got %d", tt.expectCalls, got)
+			}
+		})
+	}
+}
+
+func TestPostWithRetryHonorsRetryAfter(t *testing.T) {
+	srv, calls := scriptedServer(t, []int{429}, map[string]string{"Retry-After": "1"})
+	stream := StreamConfig{Name: "test", StreamID: "test", URL: srv.URL, Retry: RetryConfig{
+		InitialInterval: 10 * time.Millisecond,
+		MaxElapsed:      5 * time.Second,
+	}}
+
+	start := time.Now()
+	if err := postWithRetry(context.Background(), stream, "", []byte("\"line\"\n"), nil); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for Retry-After (1s), only waited %v", elapsed)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", calls.Load())
+	}
+}
+
+func TestPostWithRetryStopsOnCancel(t *testing.T) {
+	srv, _ := scriptedServer(t, []int{503, 503, 503, 503, 503}, nil)
+	stream := StreamConfig{Name: "test", StreamID: "test", URL: srv.URL, Retry: RetryConfig{
+		InitialInterval: time.Second,
+		MaxElapsed:      time.Minute,
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := postWithRetry(ctx, stream, "", []byte("\"line\"\n"), nil); err == nil {
+		t.Fatal("expected error after cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected retries to stop promptly on cancel, took %v", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(RetryConfig{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		Multiplier:      2,
+		Jitter:          0.1,
+	})
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, base := range expected {
+		base *= time.Millisecond
+		d := b.next()
+		low, high := base-base/10, base+base/10
+		if d < low || d > high {
+			t.Errorf("attempt %d: expected delay within [%v, %v], got %v", i, low, high, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > 110*time.Millisecond {
+		t.Errorf("expected reset to start over, got %v", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{"Wed, 01 Jan 2025 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 Jan 2025 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestShipErrorClassification(t *testing.T) {
+	tests := []struct {
+		status    int
+		retryable bool
+		rejected  bool
+	}{
+		{400, false, true},
+		{401, false, false},
+		{403, false, false},
+		{408, true, false},
+		{413, false, true},
+		{429, true, false},
+		{500, true, false},
+		{503, true, false},
+	}
+
+	for _, tt := range tests {
+		se := &shipError{StatusCode: tt.status}
+		if se.retryable() != tt.retryable {
+			t.Errorf("status %d: retryable = %v, want %v", tt.status, se.retryable(), tt.retryable)
+		}
+		if se.rejected() != tt.rejected {
+			t.Errorf("status %d: rejected = %v, want %v", tt.status, se.rejected(), tt.rejected)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// collectLines reads n lines from ch, failing the test if they do not arrive in time.
+func collectLines(t *testing.T, ch <-chan LogLine, n int, timeout time.Duration) []string {
+	t.Helper()
+	var lines []string
+	deadline := time.After(timeout)
+	for len(lines) < n {
+		select {
+		case ll := <-ch:
+			lines = append(lines, ll.Line)
+		case <-deadline:
+			t.Fatalf("expected %d lines, got %d: %q", n, len(lines), lines)
+		}
+	}
+	return lines
+}
+
+func expectLines(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+// TestRotationDrainsOldFile simulates logrotate's rename-and-create while the
+// writer still appends to the old file. The lines written after the last read
+// of the old file and the lines written to the new file before the tailer
+// noticed the rotation must all be shipped, in order.
+func TestRotationDrainsOldFile(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+	if err := os.WriteFile(logFile, []byte("old line 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	// The "web server" keeps its descriptor across the rename
+	writer, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+	defer writer.Close()
+
+	ch := make(chan LogLine, 10)
+	tl := &tailer{file: logFile, ch: ch}
+	defer tl.close()
+	if err := tl.reopen(); err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	ctx := context.Background()
+	tl.readAvailable(ctx)
+	expectLines(t, collectLines(t, ch, 1, time.Second), []string{"old line 1"})
+
+	t.Log("Simulating log rotation...")
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatalf("Failed to rotate log: %v", err)
+	}
+	if _, err := writer.WriteString("old line 2\nold line 3 without newline"); err != nil {
+		t.Fatalf("Failed to write to rotated log: %v", err)
+	}
+	if err := os.WriteFile(logFile, []byte("new line 1\nnew line 2\n"), 0644); err != nil {
+		t.Fatalf("Failed to create new log file: %v", err)
+	}
+
+	if !tl.checkRotation(ctx) {
+		t.Fatal("checkRotation reported cancellation")
+	}
+	if tl.f != nil {
+		t.Fatal("expected the old file to be closed after rotation")
+	}
+	if err := tl.reopen(); err != nil {
+		t.Fatalf("Failed to reopen log file: %v", err)
+	}
+	tl.readAvailable(ctx)
+
+	got := collectLines(t, ch, 4, time.Second)
+	expectLines(t, got, []string{"old line 2", "old line 3 without newline", "new line 1", "new line 2"})
+}
+
+// TestRotationWhilePathMissing checks that the old file keeps being read
+// between the rename and the creation of the new file.
+func TestRotationWhilePathMissing(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+	writer, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+	defer writer.Close()
+
+	ch := make(chan LogLine, 10)
+	tl := &tailer{file: logFile, ch: ch}
+	defer tl.close()
+	if err := tl.reopen(); err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatalf("Failed to rotate log: %v", err)
+	}
+	tl.checkRotation(ctx)
+	if tl.f == nil {
+		t.Fatal("old file was closed while the path was missing")
+	}
+
+	if _, err := writer.WriteString("late line\n"); err != nil {
+		t.Fatalf("Failed to write to rotated log: %v", err)
+	}
+	tl.readAvailable(ctx)
+	expectLines(t, collectLines(t, ch, 1, time.Second), []string{"late line"})
+}
+
+// TestTailFileFollowsRotation runs the full tailer across several rotations.
+// A new file must be read from its first line, not from its end.
+func TestTailFileFollowsRotation(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 100)
+	go tailFile(ctx, "test", logFile, ch, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	for i, name := range []string{"first", "second", "third"} {
+		// The line is appended right before the rename, so it is usually
+		// only picked up by draining the old file
+		appendFile(t, logFile, name+" generation\n")
+		if err := os.Rename(logFile, logFile+"."+strconv.Itoa(i+1)); err != nil {
+			t.Fatalf("Failed to rotate log: %v", err)
+		}
+		if err := os.WriteFile(logFile, []byte("start of "+name+" rotation\n"), 0644); err != nil {
+			t.Fatalf("Failed to create new log file: %v", err)
+		}
+
+		// Polling only notices a rotation on the reopen interval
+		got := collectLines(t, ch, 2, 2*reopenInterval)
+		expectLines(t, got, []string{name + " generation", "start of " + name + " rotation"})
+	}
+}
+
+// TestTailFileReadsFileCreatedLater checks that a file missing at startup is
+// read from its start once it appears.
+func TestTailFileReadsFileCreatedLater(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 10)
+	go tailFile(ctx, "test", logFile, ch, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.WriteFile(logFile, []byte("first line\n"), 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+	expectLines(t, collectLines(t, ch, 1, 2*reopenInterval), []string{"first line"})
+}
+
+// TestCopyTruncateRotation simulates logrotate's copytruncate: the file keeps
+// its inode but is cut back to zero, then written again from the start.
+func TestCopyTruncateRotation(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+	if err := os.WriteFile(logFile, []byte("a fairly long line before rotation\n"), 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	ch := make(chan LogLine, 10)
+	tl := &tailer{file: logFile, ch: ch}
+	defer tl.close()
+	if err := tl.reopen(); err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	ctx := context.Background()
+	tl.readAvailable(ctx)
+	collectLines(t, ch, 1, time.Second)
+
+	t.Log("Simulating copytruncate...")
+	if err := os.Truncate(logFile, 0); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+	appendFile(t, logFile, "short\n")
+
+	tl.readAvailable(ctx)
+	expectLines(t, collectLines(t, ch, 1, time.Second), []string{"short"})
+	if tl.pos.Offset != int64(len("short\n")) {
+		t.Errorf("expected offset %d after truncation, got %d", len("short\n"), tl.pos.Offset)
+	}
+}
+
+// TestTailFileFollowsCopyTruncate runs the full tailer across a truncation.
+func TestTailFileFollowsCopyTruncate(t *testing.T) {
+	testDir := t.TempDir()
+	logFile := filepath.Join(testDir, "access.log")
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 10)
+	go tailFile(ctx, "test", logFile, ch, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	appendFile(t, logFile, "line written before the truncation\n")
+	collectLines(t, ch, 1, 2*time.Second)
+
+	if err := os.Truncate(logFile, 0); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+	appendFile(t, logFile, "after\n")
+	expectLines(t, collectLines(t, ch, 1, 2*time.Second), []string{"after"})
+}
@@ -42,13 +42,7 @@ func setupWizard() error {
 	// Create config
 	cfg := Config{
 		Env: "production",
-		Discovery: struct {
-			Enabled bool `yaml:"enabled"`
-			Paths   struct {
-				Include []string `yaml:"include"`
-				Exclude []string `yaml:"exclude"`
-			} `yaml:"paths"`
-		}{
+		Discovery: DiscoveryConfig{
 			Enabled: true,
 			Paths: struct {
 				Include []string `yaml:"include"`
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestGracefulShutdownFlushes starts the agent, writes lines and sends SIGTERM
+// before the 2s batch ticker fires. The pending batch must still be shipped,
+// the offsets saved and the process must exit cleanly.
+func TestGracefulShutdownFlushes(t *testing.T) {
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "tailstream-agent")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build failed: %v\n%s", err, out)
+	}
+
+	var mu sync.Mutex
+	var received []LogEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var ev LogEvent
+			if json.Unmarshal(line, &ev) == nil {
+				received = append(received, ev)
+			}
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	logFile := filepath.Join(tmp, "app.log")
+	if err := os.WriteFile(logFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(tmp, "state")
+	cfg := []byte("streams:\n  - name: 'test-stream'\n    stream_id: 'test'\n    url: '" + srv.URL + "'\n    key: 'dummy'\n    paths:\n      - '" + logFile + "'\nupdates:\n  enabled: false\n")
+	cfgFile := filepath.Join(tmp, "agent.yaml")
+	if err := os.WriteFile(cfgFile, cfg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "run", "--config", cfgFile)
+	cmd.Env = append(os.Environ(), "TAILSTREAM_DISABLE_UPDATES=1", "TAILSTREAM_STATE_DIR="+stateDir)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start agent: %v", err)
+	}
+
+	time.Sleep(1 * time.Second)
+	appendFile(t, logFile, "first line\nsecond line\n")
+	time.Sleep(300 * time.Millisecond)
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean exit, got %v\n%s", err, out.String())
+		}
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("agent did not exit after SIGTERM:\n%s", out.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Log != "first line" || received[1].Log != "second line" {
+		t.Fatalf("expected both lines to be flushed on shutdown, got %+v\n%s", received, out.String())
+	}
+
+	reg, err := openRegistry(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, ok := reg.Get("test-stream", logFile)
+	if !ok || cp.Offset != int64(len("first line\nsecond line\n")) {
+		t.Errorf("expected checkpoint at end of shipped lines, got %+v (found=%v)", cp, ok)
+	}
+}
+
+// TestDuplicateStreamNamesStart checks that an existing config with two
+// streams of one name still starts, and that both pipelines are closed on
+// shutdown rather than one of them hanging it.
+func TestDuplicateStreamNamesStart(t *testing.T) {
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "tailstream-agent")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build failed: %v\n%s", err, out)
+	}
+
+	stream := "  - name: 'app'\n    stream_id: 'test'\n    url: 'http://127.0.0.1:1'\n    key: 'dummy'\n    paths:\n      - '" + filepath.Join(tmp, "app.log") + "'\n"
+	cfgFile := filepath.Join(tmp, "agent.yaml")
+	if err := os.WriteFile(cfgFile, []byte("updates:\n  enabled: false\nstreams:\n"+stream+stream), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "run", "--config", cfgFile)
+	cmd.Env = append(os.Environ(), "TAILSTREAM_DISABLE_UPDATES=1", "TAILSTREAM_STATE_DIR="+filepath.Join(tmp, "state"))
+	done := make(chan error, 1)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start agent: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		t.Fatalf("agent refused duplicate stream names: %v\n%s", err, out.String())
+	case <-time.After(time.Second):
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean exit, got %v\n%s", err, out.String())
+		}
+		if !bytes.Contains(out.Bytes(), []byte("shipping this one as 'app#2'")) {
+			t.Errorf("expected a warning about the renamed stream, got:\n%s", out.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("shutdown hung with duplicate stream names:\n%s", out.String())
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	spoolSegmentExt = ".ndjson"
+	spoolMetaExt    = ".meta.json"
+	spoolLockFile   = ".lock"
+
+	spoolPolicyDropOldest = "drop_oldest"
+	spoolPolicyDropNewest = "drop_newest"
+)
+
+// errSpoolFull is returned by Append when the drop_newest policy rejects a payload.
+var errSpoolFull = errors.New("spool is full")
+
+// SpoolConfig controls the on-disk queue used for batches that fail to ship.
+type SpoolConfig struct {
+	Enabled bool   `yaml:"enabled"` // Keep failed batches on disk and replay them
+	MaxMB   int    `yaml:"max_mb"`  // Size cap per stream, in megabytes
+	Policy  string `yaml:"policy"`  // drop_oldest or drop_newest once the cap is reached
+}
+
+// Spool is a per-stream write-ahead queue of NDJSON payloads. Each payload is
+// stored as its own segment file, named by a sequence number so segments are
+// replayed in the order they were written. The metadata of the batch is kept
+// in a file next to its segment.
+type Spool struct {
+	mu       sync.Mutex
+	name     string
+	dir      string
+	maxBytes int64
+	policy   string
+	segments []spoolSegment
+	size     int64
+	nextSeq  uint64
+	lock     *os.File
+	notify   chan struct{}
+	// draining lets one drain run at a time: Peek does not claim a segment,
+	// so two would both send the oldest one
+	draining sync.Mutex
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// openSpool opens (or creates) the spool directory for one stream and indexes
+// any segments left over from a previous run.
+func openSpool(name, dir string, cfg SpoolConfig) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	// Only one agent process may own a spool directory at a time
+	lock, err := os.OpenFile(filepath.Join(dir, spoolLockFile), os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("spool %s is in use by another agent process", dir)
+	}
+
+	s := &Spool{
+		name:     name,
+		dir:      dir,
+		maxBytes: int64(cfg.MaxMB) * 1024 * 1024,
+		policy:   cfg.Policy,
+		lock:     lock,
+		notify:   make(chan struct{}, 1),
+	}
+	if s.policy == "" {
+		s.policy = spoolPolicyDropOldest
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: info.Size()})
+		s.size += info.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if len(s.segments) > 0 {
+		log.Printf("SPOOL: stream '%s' has %d pending batches (%d bytes) from a previous run", name, len(s.segments), s.size)
+		s.signal()
+	}
+	return s, nil
+}
+
+// Close releases the spool directory lock. Segments stay on disk.
+func (s *Spool) Close() error {
+	if s == nil || s.lock == nil {
+		return nil
+	}
+	return s.lock.Close()
+}
+
+// Len returns the number of pending segments.
+func (s *Spool) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments)
+}
+
+// Append durably stores payload and its metadata at the tail of the spool,
+// applying the eviction policy when the size cap would be exceeded.
+func (s *Spool) Append(payload []byte, meta *batchMetadata) error {
+	if s == nil {
+		return errors.New("spool disabled")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := int64(len(payload))
+	if s.maxBytes > 0 {
+		if size > s.maxBytes {
+			return fmt.Errorf("batch of %d bytes exceeds spool size cap", size)
+		}
+		for s.size+size > s.maxBytes {
+			if s.policy == spoolPolicyDropNewest || len(s.segments) == 0 {
+				return errSpoolFull
+			}
+			oldest := s.segments[0]
+			if err := s.removeFiles(oldest.seq); err != nil {
+				return err
+			}
+			s.segments = s.segments[1:]
+			s.size -= oldest.size
+			log.Printf("SPOOL: stream '%s' full, evicted oldest batch (%d bytes)", s.name, oldest.size)
+		}
+	}
+
+	seq := s.nextSeq
+	// The metadata goes first: a segment on disk always has its metadata
+	if meta != nil {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := writeSynced(s.metaPath(seq), data); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.metaPath(seq)); err != nil && !os.IsNotExist(err) {
+		// Left behind by a crash during an earlier append
+		return err
+	}
+	if err := writeSynced(s.segmentPath(seq), payload); err != nil {
+		os.Remove(s.metaPath(seq))
+		return err
+	}
+
+	s.nextSeq++
+	s.segments = append(s.segments, spoolSegment{seq: seq, size: size})
+	s.size += size
+	s.signal()
+	return nil
+}
+
+// Peek returns the oldest pending segment without removing it.
+func (s *Spool) Peek() (uint64, []byte, bool, error) {
+	s.mu.Lock()
+	if len(s.segments) == 0 {
+		s.mu.Unlock()
+		return 0, nil, false, nil
+	}
+	seq := s.segments[0].seq
+	s.mu.Unlock()
+
+	payload, err := os.ReadFile(s.segmentPath(seq))
+	if err != nil {
+		return seq, nil, false, err
+	}
+	return seq, payload, true, nil
+}
+
+// Metadata returns the metadata stored with a segment, or nil if there is
+// none, as for segments spooled by an agent that did not store it.
+func (s *Spool) Metadata(seq uint64) *batchMetadata {
+	data, err := os.ReadFile(s.metaPath(seq))
+	if err != nil {
+		return nil
+	}
+	var meta batchMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		log.Printf("SPOOL: stream '%s' ignoring unreadable metadata of batch %d: %v", s.name, seq, err)
+		return nil
+	}
+	return &meta
+}
+
+// Remove deletes a segment once it has been shipped.
+func (s *Spool) Remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, seg := range s.segments {
+		if seg.seq != seq {
+			continue
+		}
+		if err := s.removeFiles(seq); err != nil {
+			return err
+		}
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		s.size -= seg.size
+		return nil
+	}
+	return nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+func (s *Spool) metaPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolMetaExt))
+}
+
+// removeFiles deletes a segment and its metadata.
+func (s *Spool) removeFiles(seq uint64) error {
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.metaPath(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeSynced atomically writes data to path, flushed to disk.
+func writeSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// signal wakes the replayer without blocking.
+func (s *Spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drain ships pending segments in order until the spool is empty or a
+// delivery fails. It returns the first delivery error. A drain started while
+// another is running waits for it.
+func (s *Spool) drain(ctx context.Context, stream StreamConfig) error {
+	s.draining.Lock()
+	defer s.draining.Unlock()
+	for {
+		seq, payload, ok, err := s.Peek()
+		if err != nil {
+			// An unreadable segment can never be delivered; drop it so it does not block the queue
+			log.Printf("SPOOL: stream '%s' dropping unreadable batch %d: %v", s.name, seq, err)
+			if err := s.Remove(seq); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			return nil
+		}
+		// Batches spooled before the agent stored their metadata are sent
+		// with the current one
+		meta := s.Metadata(seq)
+		if meta == nil {
+			meta = streamMetadata(stream)
+		}
+		if err := postPayload(ctx, stream, "", payload, meta); err != nil {
+			if !isRejected(err) {
+				return err
+			}
+			log.Printf("SPOOL: stream '%s' dropping batch %d rejected by the endpoint: %v", s.name, seq, err)
+		}
+		if err := s.Remove(seq); err != nil {
+			return err
+		}
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("SPOOL: replayed batch %d (%d bytes) to stream '%s'", seq, len(payload), s.name)
+		}
+	}
+}
+
+// replaySpool drains the spool in order whenever segments are pending,
+// backing off according to the stream's retry policy while the endpoint keeps failing.
+func replaySpool(ctx context.Context, stream StreamConfig, s *Spool) {
+	b := newBackoff(stream.Retry)
+
+	for {
+		if err := s.drain(ctx, stream); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay := b.next()
+			if ra := retryAfter(err); ra > 0 {
+				delay = ra
+			}
+			log.Printf("SPOOL: stream '%s' replay failed, %d batches pending, retrying in %v: %v", s.name, s.Len(), delay.Round(time.Millisecond), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		b.reset()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+		}
+	}
+}
+
+// deliver ships a batch with its metadata, or spools both when shipping
+// fails. While older batches are still spooled, new ones queue behind them so
+// delivery order is preserved. A nil error means the batch was shipped or is
+// safely on disk.
+func deliver(ctx context.Context, stream StreamConfig, s *Spool, events []Event, meta *batchMetadata) error {
+	payload := encodeNDJSON(events)
+	if s.Len() == 0 {
+		err := postWithRetry(ctx, stream, "", payload, meta)
+		if err == nil || s == nil {
+			return err
+		}
+		if isRejected(err) {
+			// Spooling a payload the endpoint refuses would only block the queue
+			return err
+		}
+		log.Printf("ship to stream '%s' failed, spooling %d events: %v", stream.Name, len(events), err)
+	}
+	if err := s.Append(payload, meta); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	return nil
+}
+
+// openStreamSpool opens the spool for a stream under the state directory.
+// Failures are logged and leave the stream without a spool.
+func openStreamSpool(cfg Config, stateDir string, stream StreamConfig) *Spool {
+	if !cfg.Spool.Enabled {
+		return nil
+	}
+	dir := filepath.Join(stateDir, "spool", spoolDirName(stream))
+	s, err := openSpool(stream.Name, dir, cfg.Spool)
+	if err != nil {
+		log.Printf("WARNING: spool disabled for stream '%s': %v", stream.Name, err)
+		return nil
+	}
+	return s
+}
+
+// spoolDirName derives a filesystem-safe directory name for a stream.
+func spoolDirName(stream StreamConfig) string {
+	name := stream.Name + "-" + stream.StreamID
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
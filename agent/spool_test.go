@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpoolOrderAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SpoolConfig{Enabled: true, MaxMB: 1}
+
+	s, err := openSpool("test", dir, cfg)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	for _, p := range []string{"first\n", "second\n", "third\n"} {
+		if err := s.Append([]byte(p), nil); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	s.Close()
+
+	// Segments left by a previous run are picked up in order
+	s, err = openSpool("test", dir, cfg)
+	if err != nil {
+		t.Fatalf("reopen spool: %v", err)
+	}
+	defer s.Close()
+	if s.Len() != 3 {
+		t.Fatalf("expected 3 pending segments, got %d", s.Len())
+	}
+
+	for _, want := range []string{"first\n", "second\n", "third\n"} {
+		seq, payload, ok, err := s.Peek()
+		if err != nil || !ok {
+			t.Fatalf("Peek: ok=%v err=%v", ok, err)
+		}
+		if string(payload) != want {
+			t.Errorf("expected %q, got %q", want, payload)
+		}
+		if err := s.Remove(seq); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected empty spool, got %d segments", s.Len())
+	}
+
+	// New segments continue after the highest sequence number seen
+	if err := s.Append([]byte("fourth\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _, _, _ := s.Peek(); seq != 3 {
+		t.Errorf("expected next sequence 3, got %d", seq)
+	}
+}
+
+func TestSpoolEviction(t *testing.T) {
+	payload := []byte(strings.Repeat("x", 400*1024))
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		s, err := openSpool("test", t.TempDir(), SpoolConfig{Enabled: true, MaxMB: 1, Policy: spoolPolicyDropOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		for i := 0; i < 3; i++ {
+			if err := s.Append(payload, nil); err != nil {
+				t.Fatalf("Append %d: %v", i, err)
+			}
+		}
+		if s.Len() != 2 {
+			t.Errorf("expected 2 segments after eviction, got %d", s.Len())
+		}
+		if seq, _, _, _ := s.Peek(); seq != 1 {
+			t.Errorf("expected oldest segment to be evicted, head is %d", seq)
+		}
+	})
+
+	t.Run("drop_newest", func(t *testing.T) {
+		s, err := openSpool("test", t.TempDir(), SpoolConfig{Enabled: true, MaxMB: 1, Policy: spoolPolicyDropNewest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		s.Append(payload, nil)
+		s.Append(payload, nil)
+		if err := s.Append(payload, nil); err != errSpoolFull {
+			t.Errorf("expected errSpoolFull, got %v", err)
+		}
+		if seq, _, _, _ := s.Peek(); seq != 0 {
+			t.Errorf("expected oldest segment to be kept, head is %d", seq)
+		}
+	})
+}
+
+func TestSpoolLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool("test", dir, SpoolConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := openSpool("test", dir, SpoolConfig{Enabled: true}); err == nil {
+		t.Error("expected second open of the same spool to fail")
+	}
+}
+
+// TestDeliverSpoolsAndReplays checks that a batch failing during an outage is
+// spooled, that later batches queue behind it, and that the replayer sends
+// them in order once the endpoint recovers.
+func TestDeliverSpoolsAndReplays(t *testing.T) {
+	var healthy atomic.Bool
+	var mu sync.Mutex
+	var received []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, strings.TrimSpace(string(b)))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	stream := StreamConfig{Name: "test", StreamID: "test", URL: srv.URL, Retry: RetryConfig{
+		InitialInterval: 10 * time.Millisecond,
+		MaxElapsed:      50 * time.Millisecond,
+	}}
+	s, err := openSpool("test", t.TempDir(), SpoolConfig{Enabled: true, MaxMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := deliver(ctx, stream, s, []Event{"one"}, nil); err != nil {
+		t.Fatalf("deliver during outage should spool, got %v", err)
+	}
+	healthy.Store(true)
+	// Still queued behind the spooled batch, even though the endpoint is back
+	if err := deliver(ctx, stream, s, []Event{"two"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 spooled batches, got %d", s.Len())
+	}
+
+	go replaySpool(ctx, stream, s)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0] != `"one"` || received[1] != `"two"` {
+		t.Fatalf("expected batches replayed in order, got %v", received)
+	}
+}
+
+func TestSpoolDirName(t *testing.T) {
+	got := spoolDirName(StreamConfig{Name: "nginx logs/prod", StreamID: "abc-123"})
+	if got != "nginx_logs_prod-abc-123" {
+		t.Errorf("unexpected spool dir name %q", got)
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestKeyFilePriority(t *testing.T) {
@@ -164,3 +170,58 @@ func TestStdinDetection(t *testing.T) {
 	// Just verify the check doesn't panic
 	t.Logf("stdin is pipe: %v, mode: %v", isPipe, stat.Mode())
 }
+
+// TestStdinModeReplaysSpoolOnce starts stdin mode with a spooled batch and
+// stdin already closed: the replayer and the final drain must not both send
+// the batch.
+func TestStdinModeReplaysSpoolOnce(t *testing.T) {
+	var sent atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(b), "spooled") {
+			sent.Add(1)
+			// Keep the batch in flight while stdin mode shuts down
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var cfg Config
+	cfg.StateDir = t.TempDir()
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.Spool = SpoolConfig{Enabled: true, MaxMB: 1}
+	cfg.Streams = []StreamConfig{{Name: "app", StreamID: "test", URL: srv.URL}}
+	t.Setenv("TAILSTREAM_STREAM_ID", "test")
+	t.Setenv("TAILSTREAM_KEY", "token")
+	t.Setenv("TAILSTREAM_KEY_FILE", "")
+
+	stdinStream := StreamConfig{Name: "stdin", StreamID: "test"}
+	s, err := openSpool("stdin", filepath.Join(cfg.StateDir, "spool", spoolDirName(stdinStream)), cfg.Spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]byte("\"spooled\"\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	saved := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = saved
+		r.Close()
+	}()
+
+	if code := runStdinMode(cfg); code != exitOK {
+		t.Errorf("expected exit code %d, got %d", exitOK, code)
+	}
+	if n := sent.Load(); n != 1 {
+		t.Errorf("expected the spooled batch to be sent once, sent %d times", n)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// pollInterval is how often an idle file is checked for new data
+	pollInterval = 250 * time.Millisecond
+	// reopenInterval is how often rotation is checked and missing files are retried
+	reopenInterval = 5 * time.Second
+)
+
+// LogLine represents a line read from a file.
+type LogLine struct {
+	File string
+	Line string
+	// Pos is the position just past this line. It is zero for stdin.
+	Pos FilePosition
+	// ObservedAt is when the agent read the line
+	ObservedAt time.Time
+	// Labels are the values captured from the file's path
+	Labels map[string]string
+}
+
+// tailer holds the state of one tailed file between reads.
+type tailer struct {
+	stream  string // name of the stream whose checkpoints are used
+	file    string
+	ch      chan<- LogLine
+	f       *os.File
+	reader  *bufio.Reader
+	pos     FilePosition
+	partial string
+	// detached is set while the path is missing but the old file is still open
+	detached bool
+	// fromStart reads a file without a checkpoint from its first line rather
+	// than its end; set for files that appeared after the agent started
+	fromStart bool
+	// labels are added to every line of the file
+	labels map[string]string
+	// resume is where to begin instead of the checkpoint: where a tailer of
+	// the same file that a config reload stopped left off, or where the
+	// stream stopped reading a file that was renamed to this path
+	resume *FilePosition
+	// sent is the position past the last line handed to the pipeline
+	sent FilePosition
+	// files learns which files the tailer reads, if set
+	files *fileTracker
+}
+
+// tailFile streams appended lines from a file.
+// If the file becomes inaccessible, it will retry opening it every 5 seconds.
+// It also detects log rotation by tracking file inodes, finishing the old file
+// before switching to the new one, and notices files truncated in place. On
+// the first open the read position comes from stream's checkpoint in reg, so
+// a restart continues where shipping stopped.
+// Where the OS supports it, change notifications wake the tailer as soon as
+// the file is written, renamed or recreated; elsewhere, such as on NFS, it
+// polls. Between reads it blocks instead of spinning.
+func tailFile(ctx context.Context, stream, file string, ch chan<- LogLine, reg *Registry) {
+	(&tailer{stream: stream, file: file, ch: ch}).run(ctx, reg)
+}
+
+func (t *tailer) run(ctx context.Context, reg *Registry) {
+	file := t.file
+	defer t.close()
+
+	// Try to open file initially
+	if err := t.open(reg); err != nil {
+		log.Printf("ERROR: Cannot open %s: %v - will retry every 5s", file, err)
+	}
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	retryTicker := time.NewTicker(reopenInterval)
+	defer retryTicker.Stop()
+
+	// With a watcher the poll ticker is left unread; the retry ticker stays
+	// as a safety net in case a notification is ever missed
+	pollC := poll.C
+	var events <-chan struct{}
+	if w, err := newFileWatcher(file); err == nil {
+		defer w.Close()
+		events = w.Events()
+		pollC = nil
+		poll.Stop()
+	} else if !errors.Is(err, errWatchUnsupported) {
+		// Most likely the inotify limits (fs.inotify.max_user_instances and
+		// max_user_watches) are used up
+		log.Printf("WARNING: Cannot watch %s for changes, polling instead: %v", file, err)
+	} else if os.Getenv("DEBUG") == "1" {
+		log.Printf("Polling %s for changes: %v", file, err)
+	}
+
+	for {
+		if !t.readAvailable(ctx) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-pollC:
+
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("ERROR: Change notifications for %s stopped - falling back to polling", file)
+				events = nil
+				poll.Reset(pollInterval)
+				pollC = poll.C
+				continue
+			}
+			if !t.checkRotation(ctx) {
+				return
+			}
+			if t.f == nil {
+				// The path may have been created again; if not, the retry
+				// ticker keeps reporting it
+				if err := t.reopen(); err == nil {
+					log.Printf("SUCCESS: Reconnected to %s after access issue/rotation", file)
+				}
+			}
+
+		case <-retryTicker.C:
+			if !t.checkRotation(ctx) {
+				return
+			}
+
+			// Retry opening file if we don't have it open
+			if t.f == nil {
+				if err := t.reopen(); err != nil {
+					log.Printf("ERROR: Still cannot access %s: %v - will keep retrying", file, err)
+					continue
+				}
+				log.Printf("SUCCESS: Reconnected to %s after access issue/rotation", file)
+			}
+		}
+	}
+}
+
+// open opens the file and positions it via startPosition.
+func (t *tailer) open(reg *Registry) error {
+	if t.resume != nil {
+		// Continue where the stream stopped reading if the path still names
+		// the same file; otherwise reopen reads it from the start
+		t.pos = *t.resume
+		return t.reopen()
+	}
+	if _, ok := reg.Get(t.stream, t.file); !ok && t.fromStart {
+		return t.reopen()
+	}
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	pos, err := startPosition(f, t.stream, t.file, reg)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.use(f, pos)
+	return nil
+}
+
+// reopen opens the path again after rotation or lost access. If it still
+// names the file that was being read, reading continues at the old offset.
+// Anything else is a new file, which is read from the start: every line in it
+// was written after the agent began tailing this path.
+func (t *tailer) reopen() error {
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	dev, ino := fileIdentity(fi)
+	pos := FilePosition{Dev: dev, Inode: ino}
+	if t.pos.Inode != 0 && (Checkpoint{FilePosition: t.pos}).matches(f, fi) {
+		pos = t.pos
+	}
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	pos.refreshFingerprint(f)
+	t.use(f, pos)
+	return nil
+}
+
+func (t *tailer) use(f *os.File, pos FilePosition) {
+	t.f = f
+	t.reader = bufio.NewReader(f)
+	t.pos = pos
+	t.sent = pos
+	t.partial = ""
+	t.detached = false
+	t.files.opened(t.stream, pos)
+}
+
+func (t *tailer) close() {
+	if t.f != nil {
+		t.f.Close()
+		t.files.closed(t.stream, t.sent)
+	}
+	t.f = nil
+	t.reader = nil
+	t.partial = ""
+}
+
+// checkRotation closes the file once its path names a different inode, so
+// the caller reopens the path. The old file is read to EOF first: lines
+// written to it just before it was renamed away would otherwise be lost.
+// While the path is missing the old descriptor is kept, since the writer may
+// still be appending to it. It returns false if ctx was cancelled.
+func (t *tailer) checkRotation(ctx context.Context) bool {
+	if t.f == nil {
+		return true
+	}
+	stat, err := os.Stat(t.file)
+	if err != nil {
+		if !t.detached {
+			log.Printf("ROTATION: File %s disappeared, will reconnect", t.file)
+			t.detached = true
+		}
+		return true
+	}
+	dev, ino := fileIdentity(stat)
+	if dev == t.pos.Dev && ino == t.pos.Inode {
+		t.detached = false
+		return true
+	}
+
+	log.Printf("ROTATION: File %s rotated (inode changed %d -> %d), reconnecting", t.file, t.pos.Inode, ino)
+	if !t.readAvailable(ctx) {
+		return false
+	}
+	// Nothing more will be appended to the old file's last line
+	if t.partial != "" {
+		line := t.partial
+		t.partial = ""
+		t.pos.Offset += int64(len(line))
+		if !t.send(ctx, line) {
+			return false
+		}
+	}
+	t.close()
+	return true
+}
+
+// readAvailable sends every complete line currently in the file. It returns
+// false when ctx was cancelled while waiting to hand a line over.
+func (t *tailer) readAvailable(ctx context.Context) bool {
+	for t.f != nil {
+		line, err := t.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				// Keep an incomplete trailing line until the rest is written
+				t.partial += line
+				if t.checkTruncation() {
+					continue
+				}
+				return true
+			}
+			log.Printf("ERROR: Lost access to %s: %v - will attempt to reconnect", t.file, err)
+			t.close()
+			return true
+		}
+		line = t.partial + line
+		t.partial = ""
+		t.pos.Offset += int64(len(line))
+		t.pos.refreshFingerprint(t.f)
+
+		if !t.send(ctx, line) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTruncation rewinds to the start of the file when it has shrunk below
+// the read position: logrotate's copytruncate copies the file away and then
+// truncates it, keeping the inode. It reports whether it rewound.
+func (t *tailer) checkTruncation() bool {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return false
+	}
+	read := t.pos.Offset + int64(len(t.partial))
+	if fi.Size() >= read {
+		return false
+	}
+	log.Printf("ROTATION: File %s truncated (size %d < offset %d), reading from start", t.file, fi.Size(), read)
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("ERROR: Lost access to %s: %v - will attempt to reconnect", t.file, err)
+		t.close()
+		return false
+	}
+	t.reader.Reset(t.f)
+	t.partial = ""
+	t.pos.Offset = 0
+	t.pos.Fingerprint = ""
+	t.pos.FingerprintLen = 0
+	t.sent = t.pos
+	return true
+}
+
+// send hands a line to the pipeline together with the position past it.
+func (t *tailer) send(ctx context.Context, line string) bool {
+	select {
+	case t.ch <- LogLine{File: t.file, Line: strings.TrimRight(line, "\r\n"), Pos: t.pos, ObservedAt: time.Now(), Labels: t.labels}:
+		t.sent = t.pos
+		return true
+	case <-ctx.Done():
+		// Not shipped, so not checkpointed: the line is read again after restart
+		return false
+	}
+}
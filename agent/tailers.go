@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRescanInterval = 10 * time.Second
+	defaultRetireAfter    = 5 * time.Minute
+)
+
+// tailerSet keeps a tailer running for every file matched by a stream's
+// globs. Files that appear later are picked up on the next rescan, and the
+// tailer of a file that has been gone for RetireAfter is stopped.
+type tailerSet struct {
+	cfg       Config
+	reg       *Registry
+	pipelines map[string]*streamPipeline
+	tailers   map[tailerKey]*runningTailer
+	wg        sync.WaitGroup
+	// updates carries reloaded configs into run
+	updates chan tailerUpdate
+	// handoff holds where tailers stopped by a reload left off, for the
+	// tailers that take over their files
+	handoff map[tailerKey]FilePosition
+	// files tells which files the tailers read, so a file renamed to a path
+	// the globs match is not read again from its start
+	files *fileTracker
+}
+
+// tailerKey identifies a tailer. A file matched by two streams has a tailer for each.
+type tailerKey struct {
+	stream string
+	file   string
+}
+
+type runningTailer struct {
+	cancel context.CancelFunc
+	// missingSince is when a rescan first failed to find the file
+	missingSince time.Time
+	// done is closed once the tailer has stopped; sent is valid from then on
+	done chan struct{}
+	sent FilePosition
+}
+
+// tailerUpdate replaces the config and pipelines of a tailerSet.
+type tailerUpdate struct {
+	cfg       Config
+	pipelines []*streamPipeline
+	// applied is closed once the tailers of pipelines left out have stopped
+	// and their input is closed
+	applied chan struct{}
+}
+
+func newTailerSet(cfg Config, reg *Registry, pipelines []*streamPipeline) *tailerSet {
+	s := &tailerSet{
+		cfg:       cfg,
+		reg:       reg,
+		pipelines: make(map[string]*streamPipeline),
+		tailers:   make(map[tailerKey]*runningTailer),
+		updates:   make(chan tailerUpdate),
+		handoff:   make(map[tailerKey]FilePosition),
+		files:     newFileTracker(),
+	}
+	for _, p := range pipelines {
+		s.pipelines[p.stream.Name] = p
+	}
+	return s
+}
+
+// run starts tailers for the files present now and rescans until ctx is
+// done. It then waits for every tailer to stop and closes the input of the
+// pipelines, so they flush what is left.
+func (s *tailerSet) run(ctx context.Context) {
+	defer func() {
+		s.wg.Wait()
+		for _, p := range s.pipelines {
+			close(p.lines)
+		}
+	}()
+
+	if s.rescan(ctx, false) == 0 {
+		log.Printf("no log files discovered yet, looking again every %v", s.rescanInterval())
+	}
+
+	ticker := time.NewTicker(s.rescanInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rescan(ctx, true)
+		case u := <-s.updates:
+			s.apply(ctx, u)
+			ticker.Reset(s.rescanInterval())
+		}
+	}
+}
+
+// update hands a reloaded config to run and waits until it is applied: the
+// tailers of pipelines not in pipelines have stopped and those pipelines'
+// input is closed. It returns false if ctx ended before run took it, in
+// which case the new pipelines' input is still open.
+func (s *tailerSet) update(ctx context.Context, cfg Config, pipelines []*streamPipeline) bool {
+	u := tailerUpdate{cfg: cfg, pipelines: pipelines, applied: make(chan struct{})}
+	select {
+	case s.updates <- u:
+	case <-ctx.Done():
+		return false
+	}
+	<-u.applied
+	return true
+}
+
+// apply stops the tailers of pipelines that u leaves out, remembering where
+// they stopped, closes those pipelines' input and rescans with u's config.
+// Files that are new to a stream are read from their end, as at startup.
+func (s *tailerSet) apply(ctx context.Context, u tailerUpdate) {
+	next := make(map[string]*streamPipeline)
+	for _, p := range u.pipelines {
+		next[p.stream.Name] = p
+	}
+	for key, rt := range s.tailers {
+		if next[key.stream] == s.pipelines[key.stream] {
+			continue
+		}
+		rt.cancel()
+		<-rt.done
+		s.handoff[key] = rt.sent
+		delete(s.tailers, key)
+	}
+	for name, p := range s.pipelines {
+		if next[name] != p {
+			close(p.lines)
+		}
+	}
+	s.cfg = u.cfg
+	s.pipelines = next
+	close(u.applied)
+	s.rescan(ctx, false)
+
+	// A changed stream is left out of one update while it restarts and comes
+	// back in the next, so its positions are kept until its new pipeline has
+	// had the chance to take them; those left over are for files it no
+	// longer matches, or for streams that are gone
+	streams := make(map[string]bool)
+	for _, stream := range s.cfg.Streams {
+		streams[stream.Name] = true
+	}
+	for key := range s.handoff {
+		if _, running := s.pipelines[key.stream]; running || !streams[key.stream] {
+			delete(s.handoff, key)
+		}
+	}
+}
+
+func (s *tailerSet) rescanInterval() time.Duration {
+	if s.cfg.Discovery.RescanInterval <= 0 {
+		return defaultRescanInterval
+	}
+	return s.cfg.Discovery.RescanInterval
+}
+
+// rescan matches the stream globs again, starts tailers for new files and
+// retires those whose file has been missing for long enough. Files found
+// after startup are read from their start, since all of their lines are new,
+// unless the stream has read them before under another name: logrotate
+// renames app.log to app.log.1, which a glob like app.log* matches again.
+// It returns the number of files matched.
+func (s *tailerSet) rescan(ctx context.Context, fromStart bool) int {
+	began := time.Now()
+	mappings, err := discover(s.cfg)
+	if err != nil {
+		log.Printf("ERROR: discovery failed: %v", err)
+		return 0
+	}
+
+	matched := 0
+	seen := make(map[tailerKey]bool)
+	present := make(map[fileID]bool)
+	for _, mapping := range mappings {
+		p, ok := s.pipelines[mapping.Stream.Name]
+		if !ok {
+			continue
+		}
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("Stream '%s': found %d files: %v", mapping.Stream.Name, len(mapping.Files), mapping.Files)
+		}
+		for _, file := range mapping.Files {
+			matched++
+			key := tailerKey{stream: mapping.Stream.Name, file: file}
+			seen[key] = true
+			fi, err := os.Stat(file)
+			if err == nil {
+				dev, ino := fileIdentity(fi)
+				present[fileID{stream: key.stream, dev: dev, ino: ino}] = true
+			}
+			if rt, ok := s.tailers[key]; ok {
+				rt.missingSince = time.Time{}
+				continue
+			}
+			if !s.start(ctx, key, p, mapping.Labels[file], fromStart, fi) {
+				continue
+			}
+			if fromStart {
+				log.Printf("DISCOVERY: New file %s for stream '%s', tailing it", file, mapping.Stream.Name)
+			}
+		}
+	}
+	// Positions in files that no glob matches any more are of no use
+	s.files.prune(present, began)
+
+	now := time.Now()
+	for key, rt := range s.tailers {
+		if seen[key] {
+			continue
+		}
+		if _, err := os.Stat(key.file); err == nil {
+			// The file is there but the stream no longer claims it, after a
+			// config reload changed its paths
+			log.Printf("DISCOVERY: File %s no longer matches stream '%s', no longer tailing it", key.file, key.stream)
+			rt.cancel()
+			delete(s.tailers, key)
+			continue
+		}
+		if rt.missingSince.IsZero() {
+			rt.missingSince = now
+			continue
+		}
+		if now.Sub(rt.missingSince) >= s.cfg.Discovery.RetireAfter {
+			log.Printf("DISCOVERY: File %s gone for %v, no longer tailing it for stream '%s'", key.file, now.Sub(rt.missingSince).Round(time.Second), key.stream)
+			rt.cancel()
+			delete(s.tailers, key)
+		}
+	}
+	return matched
+}
+
+// start starts a tailer for key. A file the stream has read before under
+// another path continues where the stream stopped reading it, and one still
+// being read under its old path is left for a later rescan, by which time
+// that tailer has finished it. fi is the file's info, or nil if it could not
+// be read. start reports whether it started a tailer.
+func (s *tailerSet) start(ctx context.Context, key tailerKey, p *streamPipeline, labels map[string]string, fromStart bool, fi os.FileInfo) bool {
+	t := &tailer{stream: key.stream, file: key.file, ch: p.lines, fromStart: fromStart, labels: labels, files: s.files}
+	if pos, ok := s.handoff[key]; ok {
+		t.resume = &pos
+		delete(s.handoff, key)
+	} else if fi != nil {
+		dev, ino := fileIdentity(fi)
+		id := fileID{stream: key.stream, dev: dev, ino: ino}
+		pos, reading, ok := s.files.lookup(id)
+		if reading {
+			if os.Getenv("DEBUG") == "1" {
+				log.Printf("Stream '%s': %s is still being read under another name", key.stream, key.file)
+			}
+			return false
+		}
+		if !ok {
+			if cp, found := s.reg.Find(key.stream, dev, ino); found {
+				pos, ok = cp.FilePosition, true
+			}
+		}
+		if ok {
+			t.resume = &pos
+		}
+	}
+
+	tctx, cancel := context.WithCancel(ctx)
+	rt := &runningTailer{cancel: cancel, done: make(chan struct{})}
+	s.tailers[key] = rt
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		t.run(tctx, s.reg)
+		rt.sent = t.sent
+		close(rt.done)
+	}()
+	return true
+}
+
+// fileID identifies a file instance read by a stream.
+type fileID struct {
+	stream   string
+	dev, ino uint64
+}
+
+// fileTracker records which files each stream's tailers have open, and
+// where they stopped reading the files they let go of. Tailers report to it
+// from their own goroutines.
+type fileTracker struct {
+	mu      sync.Mutex
+	reading map[fileID]int
+	left    map[fileID]leftFile
+}
+
+type leftFile struct {
+	pos FilePosition
+	at  time.Time
+}
+
+func newFileTracker() *fileTracker {
+	return &fileTracker{reading: make(map[fileID]int), left: make(map[fileID]leftFile)}
+}
+
+// opened records that a tailer of stream started reading the file at pos.
+// A nil *fileTracker records nothing.
+func (ft *fileTracker) opened(stream string, pos FilePosition) {
+	if ft == nil {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	id := fileID{stream: stream, dev: pos.Dev, ino: pos.Inode}
+	ft.reading[id]++
+	delete(ft.left, id)
+}
+
+// closed records that a tailer of stream stopped reading the file, having
+// handed the lines up to sent to the pipeline.
+func (ft *fileTracker) closed(stream string, sent FilePosition) {
+	if ft == nil {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	id := fileID{stream: stream, dev: sent.Dev, ino: sent.Inode}
+	if ft.reading[id]--; ft.reading[id] <= 0 {
+		delete(ft.reading, id)
+	}
+	ft.left[id] = leftFile{pos: sent, at: time.Now()}
+}
+
+// lookup reports whether a tailer is reading the file id and, if none is,
+// where the last one stopped.
+func (ft *fileTracker) lookup(id fileID) (pos FilePosition, reading, ok bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.reading[id] > 0 {
+		return FilePosition{}, true, false
+	}
+	left, ok := ft.left[id]
+	return left.pos, false, ok
+}
+
+// prune forgets where reading stopped in files not in present, a rescan
+// that began at began. A file let go of later may have been renamed after
+// that rescan looked, so it is kept for the next one.
+func (ft *fileTracker) prune(present map[fileID]bool, began time.Time) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for id, left := range ft.left {
+		if !present[id] && left.at.Before(began) {
+			delete(ft.left, id)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func rescanConfig(dir string) Config {
+	var cfg Config
+	cfg.Discovery.RescanInterval = 50 * time.Millisecond
+	cfg.Discovery.RetireAfter = 200 * time.Millisecond
+	cfg.Streams = []StreamConfig{{
+		Name:  "test",
+		Paths: []string{filepath.Join(dir, "*.log")},
+	}}
+	return cfg
+}
+
+func TestTailerSetPicksUpNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := rescanConfig(dir)
+	p := newPipeline(cfg.Streams[0], nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTailerSet(cfg, nil, []*streamPipeline{p}).run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Nothing matches yet; the set must keep looking instead of giving up
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "newsite.access.log"), []byte("first request\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that appears after startup is read from its first line
+	select {
+	case ll := <-p.lines:
+		if ll.Line != "first request" {
+			t.Errorf("expected 'first request', got %q", ll.Line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("new file was never tailed")
+	}
+}
+
+func TestTailerSetRetiresMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := rescanConfig(dir)
+	p := newPipeline(cfg.Streams[0], nil, nil)
+	s := newTailerSet(cfg, nil, []*streamPipeline{p})
+	ctx := context.Background()
+
+	if n := s.rescan(ctx, false); n != 1 {
+		t.Fatalf("expected 1 matched file, got %d", n)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// A short absence, such as during rotation, keeps the tailer
+	s.rescan(ctx, true)
+	if len(s.tailers) != 1 {
+		t.Fatal("tailer retired as soon as its file went missing")
+	}
+
+	time.Sleep(cfg.Discovery.RetireAfter)
+	s.rescan(ctx, true)
+	if len(s.tailers) != 0 {
+		t.Fatal("tailer for a file gone longer than retire_after was not retired")
+	}
+
+	// The retired tailer stops on its own
+	waited := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("retired tailer did not stop")
+	}
+}
+
+func TestTailerSetClosesPipelinesOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	cfg := rescanConfig(dir)
+	p := newPipeline(cfg.Streams[0], nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTailerSet(cfg, nil, []*streamPipeline{p}).run(ctx)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("tailer set stopped while no files matched")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tailer set did not stop after cancellation")
+	}
+	if _, ok := <-p.lines; ok {
+		t.Error("expected the pipeline input to be closed")
+	}
+}
+
+func TestTailerSetUpdateHandsOverFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, []byte("before startup\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := rescanConfig(dir)
+	old := newPipeline(cfg.Streams[0], nil, nil)
+	s := newTailerSet(cfg, nil, []*streamPipeline{old})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, file, "one\n")
+	got := collectLines(t, old.lines, 1, 2*time.Second)
+	appendFile(t, file, "two\n")
+
+	// The reloaded stream takes the file over without a checkpoint to go on
+	replacement := newPipeline(cfg.Streams[0], nil, nil)
+	if !s.update(ctx, cfg, []*streamPipeline{replacement}) {
+		t.Fatal("update was not applied")
+	}
+	for ll := range old.lines {
+		got = append(got, ll.Line)
+	}
+	appendFile(t, file, "three\n")
+	for len(got) < 3 {
+		select {
+		case ll := <-replacement.lines:
+			got = append(got, ll.Line)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected one, two and three, got %q", got)
+		}
+	}
+
+	if len(got) != 3 || got[0] != "one" || got[1] != "two" || got[2] != "three" {
+		t.Errorf("expected every line exactly once across the reload, got %q", got)
+	}
+	select {
+	case ll := <-replacement.lines:
+		t.Errorf("unexpected line %q after the reload", ll.Line)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestTailerSetHandoffSpansTwoUpdates follows a reload of a changed stream:
+// one update stops its tailers and the next starts its replacement. Without
+// a registry the handed over positions are all the new tailers have to go on.
+func TestTailerSetHandoffSpansTwoUpdates(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := rescanConfig(dir)
+	old := newPipeline(cfg.Streams[0], nil, nil)
+	s := newTailerSet(cfg, nil, []*streamPipeline{old})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, file, "one\n")
+	collectLines(t, old.lines, 1, 2*time.Second)
+
+	if !s.update(ctx, cfg, nil) {
+		t.Fatal("update was not applied")
+	}
+	// Written while no tailer follows the file
+	appendFile(t, file, "two\n")
+
+	replacement := newPipeline(cfg.Streams[0], nil, nil)
+	if !s.update(ctx, cfg, []*streamPipeline{replacement}) {
+		t.Fatal("update was not applied")
+	}
+	appendFile(t, file, "three\n")
+
+	expectLines(t, collectLines(t, replacement.lines, 2, 2*time.Second), []string{"two", "three"})
+}
+
+// TestTailerSetSkipsRotatedFiles follows logrotate renaming app.log to
+// app.log.1 under a glob that matches both: the renamed file's lines were
+// shipped as app.log and must not be read again from its start.
+func TestTailerSetSkipsRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := rescanConfig(dir)
+	cfg.Streams[0].Paths = []string{filepath.Join(dir, "app.log*")}
+	p := newPipeline(cfg.Streams[0], nil, nil)
+	s := newTailerSet(cfg, nil, []*streamPipeline{p})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, file, "one\n")
+	collectLines(t, p.lines, 1, 2*time.Second)
+
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, file+".1", "late\n")
+	if err := os.WriteFile(file, []byte("two\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collectLines(t, p.lines, 2, 7*time.Second)
+	sort.Strings(got)
+	expectLines(t, got, []string{"late", "two"})
+	select {
+	case ll := <-p.lines:
+		t.Errorf("unexpected line %q from %s", ll.Line, ll.File)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// TestTailerSetResumesRotatedFileFromCheckpoint restarts after a rotation
+// that happened while the agent was down: the renamed file continues from
+// the checkpoint taken under its old name.
+func TestTailerSetResumesRotatedFileFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, []byte("one\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := openRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, ino := fileIdentity(fi)
+	if err := reg.Commit("test", file, FilePosition{Dev: dev, Inode: ino, Offset: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, file+".1", "two\n")
+	if err := os.WriteFile(file, []byte("three\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := rescanConfig(dir)
+	cfg.Streams[0].Paths = []string{filepath.Join(dir, "app.log*")}
+	p := newPipeline(cfg.Streams[0], nil, nil)
+	s := newTailerSet(cfg, reg, []*streamPipeline{p})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+	s.rescan(ctx, false)
+
+	got := collectLines(t, p.lines, 2, 2*time.Second)
+	sort.Strings(got)
+	expectLines(t, got, []string{"three", "two"})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts with a special meaning in TimestampConfig.Layout.
+const (
+	layoutUnix   = "unix"    // seconds since the epoch, fractions allowed
+	layoutUnixMs = "unix_ms" // milliseconds since the epoch
+)
+
+// TimestampConfig extracts the time an event happened from the line, either
+// with Pattern and Layout or from a JSON Field.
+type TimestampConfig struct {
+	Pattern  string `yaml:"pattern,omitempty"`  // Regexp; its first group (or whole match) holds the time
+	Field    string `yaml:"field,omitempty"`    // JSON field holding the time; dots reach into nested objects
+	Layout   string `yaml:"layout,omitempty"`   // Go time layout, unix or unix_ms (default RFC 3339)
+	Timezone string `yaml:"timezone,omitempty"` // IANA zone for times without an offset (default: the host's zone)
+}
+
+func (c TimestampConfig) enabled() bool {
+	return c.Pattern != "" || c.Field != ""
+}
+
+type timestampExtractor struct {
+	pattern *regexp.Regexp
+	field   []string
+	layout  string
+	loc     *time.Location
+}
+
+func newTimestampExtractor(cfg TimestampConfig) (*timestampExtractor, error) {
+	if cfg.Pattern != "" && cfg.Field != "" {
+		return nil, fmt.Errorf("set either pattern or field, not both")
+	}
+	x := &timestampExtractor{layout: cfg.Layout, loc: time.Local}
+	if x.layout == "" {
+		x.layout = time.RFC3339Nano
+	}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		x.pattern = re
+	}
+	if cfg.Field != "" {
+		x.field = strings.Split(cfg.Field, ".")
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		x.loc = loc
+	}
+	return x, nil
+}
+
+// fromLine extracts the time from a line with the configured pattern, or
+// from the JSON field when the line holds a JSON object.
+func (x *timestampExtractor) fromLine(line string) (time.Time, bool) {
+	if x.pattern != nil {
+		m := x.pattern.FindStringSubmatch(line)
+		if m == nil {
+			return time.Time{}, false
+		}
+		if len(m) > 1 {
+			return x.parse(m[1])
+		}
+		return x.parse(m[0])
+	}
+
+	var obj map[string]json.RawMessage
+	if json.Unmarshal([]byte(strings.TrimSpace(line)), &obj) != nil {
+		return time.Time{}, false
+	}
+	return x.fromObject(obj)
+}
+
+// fromObject extracts the time from the JSON field.
+func (x *timestampExtractor) fromObject(obj map[string]json.RawMessage) (time.Time, bool) {
+	raw, ok := lookupField(obj, x.field)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return x.parse(s)
+	}
+	var n json.Number
+	if json.Unmarshal(raw, &n) == nil {
+		return x.parse(n.String())
+	}
+	return time.Time{}, false
+}
+
+// lookupField returns the value at path, where each element is the key of
+// a nested object.
+func lookupField(obj map[string]json.RawMessage, path []string) (json.RawMessage, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	for i, key := range path {
+		v, ok := obj[key]
+		if !ok {
+			return nil, false
+		}
+		if i == len(path)-1 {
+			return v, true
+		}
+		obj = nil
+		if json.Unmarshal(v, &obj) != nil {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// parse reads s with the configured layout. Times without an offset are
+// taken to be in the configured zone.
+func (x *timestampExtractor) parse(s string) (time.Time, bool) {
+	switch x.layout {
+	case layoutUnix, layoutUnixMs:
+		return parseEpoch(s, x.layout == layoutUnixMs)
+	}
+	t, err := time.ParseInLocation(x.layout, s, x.loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// Layouts without a year, such as syslog's, mean the current one
+	if t.Year() == 0 {
+		t = t.AddDate(time.Now().In(x.loc).Year(), 0, 0)
+	}
+	return t, true
+}
+
+// parseEpoch reads seconds (or milliseconds) since the epoch. Plain decimal
+// numbers are read digit by digit so that no precision is lost to floats.
+func parseEpoch(s string, millis bool) (time.Time, bool) {
+	unit := int64(time.Second)
+	if millis {
+		unit = int64(time.Millisecond)
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err == nil && len(frac) <= 9 {
+		f, ferr := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if ferr == nil {
+			return time.Unix(0, w*unit+f*unit/1e9).UTC(), true
+		}
+	}
+
+	// Exponent notation and the like
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(v*float64(unit))).UTC(), true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimestampExtraction(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  TimestampConfig
+		line string
+		want time.Time
+	}{
+		{
+			name: "pattern with offset",
+			cfg:  TimestampConfig{Pattern: `^(\S+) `},
+			line: "2024-05-01T12:00:00.5+02:00 ERROR boom",
+			want: time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC),
+		},
+		{
+			name: "pattern without offset uses timezone",
+			cfg:  TimestampConfig{Pattern: `^\[([^\]]+)\]`, Layout: "2006-01-02 15:04:05", Timezone: "Europe/Berlin"},
+			line: "[2024-05-01 12:00:00] production.ERROR: Connection timeout",
+			want: time.Date(2024, 5, 1, 12, 0, 0, 0, berlin),
+		},
+		{
+			name: "json field",
+			cfg:  TimestampConfig{Field: "time"},
+			line: `{"time":"2024-05-01T12:00:00Z","msg":"hi"}`,
+			want: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "nested json field in unix seconds",
+			cfg:  TimestampConfig{Field: "meta.ts", Layout: layoutUnix},
+			line: `{"meta":{"ts":1714564800.25},"msg":"hi"}`,
+			want: time.Date(2024, 5, 1, 12, 0, 0, 25e7, time.UTC),
+		},
+		{
+			name: "json field in unix milliseconds",
+			cfg:  TimestampConfig{Field: "ts", Layout: layoutUnixMs},
+			line: `{"ts":1714564800123}`,
+			want: time.Date(2024, 5, 1, 12, 0, 0, 123e6, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := newTimestampExtractor(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := x.fromLine(tt.line)
+			if !ok {
+				t.Fatalf("no timestamp extracted from %q", tt.line)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTimestampWithoutYear(t *testing.T) {
+	x, err := newTimestampExtractor(TimestampConfig{Pattern: `^(\w{3} [ \d]\d \d\d:\d\d:\d\d)`, Layout: time.Stamp, Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := x.fromLine("May  1 12:00:00 host sshd[1]: Accepted publickey")
+	if !ok {
+		t.Fatal("no timestamp extracted")
+	}
+	if got.Year() != time.Now().UTC().Year() || got.Month() != time.May || got.Day() != 1 {
+		t.Errorf("expected May 1 of the current year, got %v", got)
+	}
+}
+
+func TestTimestampConfigErrors(t *testing.T) {
+	for _, cfg := range []TimestampConfig{
+		{Pattern: "(", Layout: time.RFC3339},
+		{Pattern: "x", Field: "y"},
+		{Field: "ts", Timezone: "Not/AZone"},
+	} {
+		if _, err := newTimestampExtractor(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestEventsCarryObservedAndEventTime(t *testing.T) {
+	observed := time.Date(2024, 5, 1, 12, 0, 5, 0, time.UTC)
+
+	// Raw line, no extraction: only the observed time
+	lp := newLineParser(StreamConfig{Name: "raw"})
+	ev, _ := lp.parse(LogLine{File: "/a.log", Line: "hello", ObservedAt: observed})
+	raw := ev.(LogEvent)
+	if !raw.ObservedAt.Equal(observed) || raw.Timestamp != nil {
+		t.Errorf("expected observed_at only, got %+v", raw)
+	}
+
+	// A parsed access log carries its own time
+	lp = newLineParser(StreamConfig{Name: "nginx", Format: formatCombined})
+	ev, _ = lp.parse(LogLine{File: "/a.log", Line: `1.2.3.4 - - [01/May/2024:12:00:00 +0000] "GET / HTTP/1.1" 200 1 "-" "-"`, ObservedAt: observed})
+	access := ev.(LogEvent)
+	if access.Timestamp == nil || !access.Timestamp.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the access log time as timestamp, got %v", access.Timestamp)
+	}
+
+	// JSON passthrough puts both times in the metadata
+	lp = newLineParser(StreamConfig{Name: "app", Format: formatJSON, Timestamp: TimestampConfig{Field: "time"}})
+	ev, _ = lp.parse(LogLine{File: "/a.log", Line: `{"time":"2024-05-01T11:59:59Z","msg":"hi"}`, ObservedAt: observed})
+	b, _ := json.Marshal(ev)
+	var out struct {
+		Meta EventMeta `json:"_tailstream"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Meta.ObservedAt.Equal(observed) || out.Meta.Timestamp == nil || !out.Meta.Timestamp.Equal(time.Date(2024, 5, 1, 11, 59, 59, 0, time.UTC)) {
+		t.Errorf("expected observed and event time in metadata, got %s", b)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig adds trust anchors, a client certificate and stricter checks to
+// the system defaults. Certificate files are read again when they change.
+type TLSConfig struct {
+	CAFile     string   `yaml:"ca_file,omitempty"`     // PEM bundle trusted in addition to the system roots
+	CertFile   string   `yaml:"cert_file,omitempty"`   // PEM client certificate for mutual TLS
+	KeyFile    string   `yaml:"key_file,omitempty"`    // PEM private key of CertFile
+	MinVersion string   `yaml:"min_version,omitempty"` // 1.2 (default) or 1.3
+	PinSHA256  []string `yaml:"pin_sha256,omitempty"`  // Base64 SHA-256 of a SubjectPublicKeyInfo that must appear in the chain
+}
+
+func (tc TLSConfig) isZero() bool {
+	return tc.CAFile == "" && tc.CertFile == "" && tc.KeyFile == "" && tc.MinVersion == "" && len(tc.PinSHA256) == 0
+}
+
+// merge returns tc with the fields set in over replacing its own.
+func (tc TLSConfig) merge(over TLSConfig) TLSConfig {
+	if over.CAFile != "" {
+		tc.CAFile = over.CAFile
+	}
+	if over.CertFile != "" || over.KeyFile != "" {
+		tc.CertFile, tc.KeyFile = over.CertFile, over.KeyFile
+	}
+	if over.MinVersion != "" {
+		tc.MinVersion = over.MinVersion
+	}
+	if len(over.PinSHA256) > 0 {
+		tc.PinSHA256 = over.PinSHA256
+	}
+	return tc
+}
+
+// newTLSClientConfig builds the client side of tc. It returns nil for a zero
+// TLSConfig, leaving the transport's defaults in place, and an error when a
+// setting is invalid or a file cannot be loaded.
+func newTLSClientConfig(tc TLSConfig) (*tls.Config, error) {
+	if tc.isZero() {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch tc.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported min_version '%s' (want 1.2 or 1.3)", tc.MinVersion)
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+
+	pins := make(map[string]bool)
+	for _, p := range tc.PinSHA256 {
+		p = strings.TrimPrefix(p, "sha256/")
+		if sum, err := base64.StdEncoding.DecodeString(p); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin_sha256 '%s': want the base64 SHA-256 of a public key", p)
+		}
+		pins[p] = true
+	}
+
+	v := &tlsVerifier{ca: newWatchedFile(tc.CAFile), cert: newWatchedFile(tc.CertFile), key: newWatchedFile(tc.KeyFile), pins: pins}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	if tc.CertFile != "" {
+		cfg.GetClientCertificate = v.clientCertificate
+	}
+	if tc.CAFile != "" {
+		// The roots change when the CA file does, so the chain is verified
+		// in VerifyConnection against the current pool instead of RootCAs
+		cfg.InsecureSkipVerify = true
+	}
+	if tc.CAFile != "" || len(pins) > 0 {
+		cfg.VerifyConnection = v.verifyConnection
+	}
+	return cfg, nil
+}
+
+// watchedFile remembers the size and modification time a file had when it
+// was last read.
+type watchedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func newWatchedFile(path string) *watchedFile {
+	if path == "" {
+		return nil
+	}
+	return &watchedFile{path: path}
+}
+
+// changed reports whether the file differs from when it was last read.
+func (f *watchedFile) changed() bool {
+	if f == nil {
+		return false
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	return fi.Size() != f.size || !fi.ModTime().Equal(f.modTime)
+}
+
+func (f *watchedFile) read() ([]byte, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.size, f.modTime = fi.Size(), fi.ModTime()
+	return data, nil
+}
+
+// tlsVerifier holds the certificates of one TLSConfig and reloads them when
+// their files change, so rotated certificates apply to new connections
+// without a restart.
+type tlsVerifier struct {
+	mu       sync.Mutex
+	ca       *watchedFile
+	cert     *watchedFile
+	key      *watchedFile
+	roots    *x509.CertPool
+	clientKP *tls.Certificate
+	pins     map[string]bool
+}
+
+// reload reads the files that changed since they were last read.
+func (v *tlsVerifier) reload() error {
+	if v.ca.changed() || (v.ca != nil && v.roots == nil) {
+		data, err := v.ca.read()
+		if err != nil {
+			return fmt.Errorf("cannot read ca_file: %v", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("ca_file %s holds no PEM certificates", v.ca.path)
+		}
+		v.roots = roots
+	}
+	if v.cert.changed() || v.key.changed() || (v.cert != nil && v.clientKP == nil) {
+		certPEM, err := v.cert.read()
+		if err != nil {
+			return fmt.Errorf("cannot read cert_file: %v", err)
+		}
+		keyPEM, err := v.key.read()
+		if err != nil {
+			return fmt.Errorf("cannot read key_file: %v", err)
+		}
+		kp, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %v", err)
+		}
+		v.clientKP = &kp
+	}
+	return nil
+}
+
+// refresh picks up rotated files before a handshake. A file caught mid-write
+// or otherwise broken is reported and the certificates loaded before stay
+// in use; its change is noticed again on the next handshake.
+func (v *tlsVerifier) refresh() {
+	if err := v.reload(); err != nil {
+		log.Printf("WARNING: Cannot reload TLS certificates: %v - keeping the previous ones", err)
+		if v.ca != nil {
+			v.ca.modTime = time.Time{}
+		}
+		if v.cert != nil {
+			v.cert.modTime = time.Time{}
+		}
+	}
+}
+
+func (v *tlsVerifier) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.refresh()
+	return v.clientKP, nil
+}
+
+func (v *tlsVerifier) verifyConnection(cs tls.ConnectionState) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	chains := cs.VerifiedChains
+	if v.ca != nil {
+		v.refresh()
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: server sent no certificate")
+		}
+		opts := x509.VerifyOptions{DNSName: cs.ServerName, Roots: v.roots, Intermediates: x509.NewCertPool()}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		var err error
+		if chains, err = cs.PeerCertificates[0].Verify(opts); err != nil {
+			return err
+		}
+	}
+	if len(v.pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, c := range chain {
+			if v.pins[spkiPin(c)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("tls: no certificate in the chain of %s matches pin_sha256", cs.ServerName)
+}
+
+// spkiPin is the base64 SHA-256 of a certificate's public key, as used in pin_sha256.
+func spkiPin(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var testSerial atomic.Int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial.Add(1)),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1 signed by ca, as PEM and ready to use.
+func (ca *testCA) issue(t *testing.T, cn string) (certPEM, keyPEM []byte, kp tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial.Add(1)),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	kp, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM, kp
+}
+
+// rotateFile replaces a certificate file the way a renewal would, with a
+// modification time that differs from the previous one.
+func rotateFile(t *testing.T, path string, data []byte, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsServer serves the certificate in cert, which tests may swap, and
+// opens a new connection, and so a handshake, for every request.
+func tlsServer(t *testing.T, cert *atomic.Pointer[tls.Certificate], handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{Certificates: []tls.Certificate{*cert.Load()}}, nil
+	}}
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func ship(stream StreamConfig) error {
+	stream.StreamID = "test"
+	return postPayload(context.Background(), stream, "token", encodeNDJSON(accessLogEvents(1)), nil)
+}
+
+func TestTLSCustomCA(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{})
+	dir := t.TempDir()
+	ca := newTestCA(t, "Gateway CA")
+	_, _, serverKP := ca.issue(t, "ingest")
+	var cert atomic.Pointer[tls.Certificate]
+	cert.Store(&serverKP)
+	srv := tlsServer(t, &cert, func(w http.ResponseWriter, r *http.Request) {})
+
+	caFile := filepath.Join(dir, "ca.pem")
+	rotateFile(t, caFile, ca.pem, 0)
+
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL}); err == nil {
+		t.Error("expected the system trust store to reject the gateway's certificate")
+	}
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile}}); err != nil {
+		t.Errorf("expected the extra CA to be trusted: %v", err)
+	}
+
+	// The gateway moves to a new CA; trusting it only takes a new CA file
+	newCA := newTestCA(t, "New Gateway CA")
+	_, _, newKP := newCA.issue(t, "ingest")
+	cert.Store(&newKP)
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile}}); err == nil {
+		t.Error("expected a certificate from an untrusted CA to be rejected")
+	}
+	rotateFile(t, caFile, newCA.pem, time.Minute)
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile}}); err != nil {
+		t.Errorf("expected the rotated CA file to be picked up: %v", err)
+	}
+}
+
+func TestTLSGlobalCAAppliesToAllRequests(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "Gateway CA")
+	_, _, serverKP := ca.issue(t, "ingest")
+	var cert atomic.Pointer[tls.Certificate]
+	cert.Store(&serverKP)
+	srv := tlsServer(t, &cert, func(w http.ResponseWriter, r *http.Request) {})
+	caFile := filepath.Join(dir, "ca.pem")
+	rotateFile(t, caFile, ca.pem, 0)
+
+	useHTTPConfig(t, HTTPConfig{TLS: TLSConfig{CAFile: caFile}})
+	resp, err := apiClient().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected API requests to trust the global CA: %v", err)
+	}
+	resp.Body.Close()
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL}); err != nil {
+		t.Errorf("expected ingest to trust the global CA: %v", err)
+	}
+}
+
+func TestTLSClientCertificateReload(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{})
+	dir := t.TempDir()
+	ca := newTestCA(t, "Ingest CA")
+	_, _, serverKP := ca.issue(t, "ingest")
+	var cert atomic.Pointer[tls.Certificate]
+	cert.Store(&serverKP)
+
+	clients := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverKP}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "agent.pem"), filepath.Join(dir, "agent.key")
+	rotateFile(t, caFile, ca.pem, 0)
+	certPEM, keyPEM, _ := ca.issue(t, "agent-1")
+	rotateFile(t, certFile, certPEM, 0)
+	rotateFile(t, keyFile, keyPEM, 0)
+	stream := StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}}
+
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile}}); err == nil {
+		t.Error("expected the server to require a client certificate")
+	}
+	if err := ship(stream); err != nil {
+		t.Fatalf("expected mutual TLS to succeed: %v", err)
+	}
+	if cn := <-clients; cn != "agent-1" {
+		t.Errorf("expected the agent-1 certificate, got %s", cn)
+	}
+
+	certPEM, keyPEM, _ = ca.issue(t, "agent-2")
+	rotateFile(t, certFile, certPEM, time.Minute)
+	rotateFile(t, keyFile, keyPEM, time.Minute)
+	if err := ship(stream); err != nil {
+		t.Fatalf("expected the rotated certificate to work: %v", err)
+	}
+	if cn := <-clients; cn != "agent-2" {
+		t.Errorf("expected the rotated agent-2 certificate, got %s", cn)
+	}
+
+	// A broken renewal keeps the last good certificate in use
+	rotateFile(t, certFile, []byte("not a certificate"), 2*time.Minute)
+	if err := ship(stream); err != nil {
+		t.Fatalf("expected the previous certificate to stay in use: %v", err)
+	}
+	if cn := <-clients; cn != "agent-2" {
+		t.Errorf("expected the agent-2 certificate, got %s", cn)
+	}
+}
+
+func TestTLSPinning(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{})
+	dir := t.TempDir()
+	ca := newTestCA(t, "Ingest CA")
+	_, _, serverKP := ca.issue(t, "ingest")
+	var cert atomic.Pointer[tls.Certificate]
+	cert.Store(&serverKP)
+	srv := tlsServer(t, &cert, func(w http.ResponseWriter, r *http.Request) {})
+	caFile := filepath.Join(dir, "ca.pem")
+	rotateFile(t, caFile, ca.pem, 0)
+
+	leaf, _ := x509.ParseCertificate(serverKP.Certificate[0])
+	other := newTestCA(t, "Other CA")
+	tests := []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"leaf", []string{spkiPin(leaf)}, true},
+		{"ca", []string{"sha256/" + spkiPin(ca.cert)}, true},
+		{"backup pin", []string{spkiPin(other.cert), spkiPin(ca.cert)}, true},
+		{"mismatch", []string{spkiPin(other.cert)}, false},
+	}
+	for _, tt := range tests {
+		err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile, PinSHA256: tt.pins}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ok = %v, want %v (%v)", tt.name, err == nil, tt.ok, err)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{})
+	dir := t.TempDir()
+	ca := newTestCA(t, "Ingest CA")
+	_, _, serverKP := ca.issue(t, "ingest")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverKP}, MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	rotateFile(t, caFile, ca.pem, 0)
+
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile, MinVersion: "1.2"}}); err != nil {
+		t.Errorf("expected TLS 1.2 to be accepted: %v", err)
+	}
+	if err := ship(StreamConfig{Name: "app", URL: srv.URL, TLS: TLSConfig{CAFile: caFile, MinVersion: "1.3"}}); err == nil {
+		t.Error("expected a TLS 1.2 server to be refused with min_version 1.3")
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	rotateFile(t, notPEM, []byte("not a certificate"), 0)
+
+	for _, tc := range []TLSConfig{
+		{MinVersion: "1.1"},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: notPEM},
+		{CertFile: notPEM},
+		{CertFile: notPEM, KeyFile: notPEM},
+		{PinSHA256: []string{"not base64!"}},
+		{PinSHA256: []string{"c2hvcnQ="}},
+	} {
+		if _, err := newTLSClientConfig(tc); err == nil {
+			t.Errorf("expected %+v to be rejected", tc)
+		}
+	}
+	if _, err := streamClient(StreamConfig{Name: "app", TLS: TLSConfig{MinVersion: "1.1"}}); err == nil {
+		t.Error("expected streamClient to report invalid stream settings")
+	}
+	if err := configureHTTP(HTTPConfig{TLS: TLSConfig{MinVersion: "1.1"}}); err == nil {
+		t.Error("expected configureHTTP to reject invalid global settings")
+	}
+}
+
+func TestTLSMerge(t *testing.T) {
+	global := TLSConfig{CAFile: "/etc/ca.pem", CertFile: "/etc/a.pem", KeyFile: "/etc/a.key", MinVersion: "1.2"}
+	got := global.merge(TLSConfig{CertFile: "/etc/b.pem", KeyFile: "/etc/b.key", PinSHA256: []string{"pin"}})
+	if got.CAFile != "/etc/ca.pem" || got.CertFile != "/etc/b.pem" || got.KeyFile != "/etc/b.key" || got.MinVersion != "1.2" || len(got.PinSHA256) != 1 {
+		t.Errorf("unexpected merged settings: %+v", got)
+	}
+}
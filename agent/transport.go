@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPConfig tunes the connections the agent makes for ingest, OAuth and
+// updates. Zero fields use the defaults.
+type HTTPConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout,omitempty"`            // TCP connect (default 10s)
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout,omitempty"`   // TLS handshake (default 10s)
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"` // Wait for the response after the request is sent (default 10s)
+	RequestTimeout        time.Duration `yaml:"request_timeout,omitempty"`         // Whole API and ingest request, body included (default 10s)
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout,omitempty"`       // How long an unused connection is kept open (default 90s)
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host,omitempty"` // Unused connections kept per host (default 4)
+	DisableHTTP2          bool          `yaml:"disable_http2,omitempty"`           // Stick to HTTP/1.1
+	Proxy                 ProxyConfig   `yaml:"proxy,omitempty"`                   // Proxy for all outbound requests
+	TLS                   TLSConfig     `yaml:"tls,omitempty"`                     // Trust and client certificates for all outbound requests
+}
+
+// downloadTimeout bounds update downloads, which are far larger than API
+// responses and get their own overall timeout.
+const downloadTimeout = 5 * time.Minute
+
+// withDefaults fills unset fields with the defaults.
+func (hc HTTPConfig) withDefaults() HTTPConfig {
+	if hc.DialTimeout <= 0 {
+		hc.DialTimeout = 10 * time.Second
+	}
+	if hc.TLSHandshakeTimeout <= 0 {
+		hc.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if hc.ResponseHeaderTimeout <= 0 {
+		hc.ResponseHeaderTimeout = 10 * time.Second
+	}
+	if hc.RequestTimeout <= 0 {
+		hc.RequestTimeout = 10 * time.Second
+	}
+	if hc.IdleConnTimeout <= 0 {
+		hc.IdleConnTimeout = 90 * time.Second
+	}
+	if hc.MaxIdleConnsPerHost <= 0 {
+		hc.MaxIdleConnsPerHost = 4
+	}
+	return hc
+}
+
+// httpClients share one transport, so every request the agent makes reuses
+// the same connection pool. Streams with TLS settings of their own get a
+// transport per distinct setting.
+type httpClients struct {
+	cfg       HTTPConfig
+	proxy     func(*http.Request) (*url.URL, error)
+	transport *http.Transport
+	api       *http.Client // ingest, OAuth and GitHub API requests
+	download  *http.Client // release archives and checksums
+
+	mu      sync.Mutex
+	streams map[string]*http.Client // by effective TLSConfig
+}
+
+var sharedHTTP atomic.Pointer[httpClients]
+
+func init() {
+	configureHTTP(HTTPConfig{})
+}
+
+// configureHTTP replaces the shared clients with ones built from hc. It is
+// called once the config is loaded; until then the defaults apply. Invalid
+// TLS settings are an error and leave the current clients in place.
+func configureHTTP(hc HTTPConfig) error {
+	hc = hc.withDefaults()
+	tlsCfg, err := newTLSClientConfig(hc.TLS)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	proxy, err := proxyFunc(hc.Proxy)
+	if err != nil {
+		log.Printf("ERROR: %v - using the proxy environment variables instead", err)
+		proxy = http.ProxyFromEnvironment
+	} else if hc.Proxy.URL != "" && os.Getenv("DEBUG") == "1" {
+		log.Printf("Using proxy %s for outbound requests", redactedURL(hc.Proxy.URL))
+	}
+
+	t := newTransport(hc, proxy, tlsCfg)
+	rt := userAgentTransport{t}
+	old := sharedHTTP.Swap(&httpClients{
+		cfg:       hc,
+		proxy:     proxy,
+		transport: t,
+		api:       &http.Client{Transport: rt, Timeout: hc.RequestTimeout},
+		download:  &http.Client{Transport: rt, Timeout: downloadTimeout},
+		streams:   make(map[string]*http.Client),
+	})
+	if old != nil {
+		old.closeIdleConnections()
+	}
+	return nil
+}
+
+func newTransport(hc HTTPConfig, proxy func(*http.Request) (*url.URL, error), tlsCfg *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: hc.DialTimeout, KeepAlive: 30 * time.Second}
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsCfg,
+		ForceAttemptHTTP2:     !hc.DisableHTTP2,
+		TLSHandshakeTimeout:   hc.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: hc.ResponseHeaderTimeout,
+		IdleConnTimeout:       hc.IdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   hc.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+	if hc.DisableHTTP2 {
+		// A non-nil, empty map turns off the transport's HTTP/2 upgrade
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+func (c *httpClients) closeIdleConnections() {
+	c.transport.CloseIdleConnections()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sc := range c.streams {
+		sc.CloseIdleConnections()
+	}
+}
+
+// streamClient returns the client for ingest requests to stream. Streams
+// without TLS settings share the API client; the others get a client for
+// the global TLS settings merged with their own.
+func streamClient(stream StreamConfig) (*http.Client, error) {
+	c := sharedHTTP.Load()
+	if stream.TLS.isZero() {
+		return c.api, nil
+	}
+	tc := c.cfg.TLS.merge(stream.TLS)
+	key := fmt.Sprintf("%q", tc)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sc, ok := c.streams[key]; ok {
+		return sc, nil
+	}
+	tlsCfg, err := newTLSClientConfig(tc)
+	if err != nil {
+		return nil, err
+	}
+	sc := &http.Client{Transport: userAgentTransport{newTransport(c.cfg, c.proxy, tlsCfg)}, Timeout: c.cfg.RequestTimeout}
+	c.streams[key] = sc
+	return sc, nil
+}
+
+// apiClient returns the client for API and ingest requests.
+func apiClient() *http.Client {
+	return sharedHTTP.Load().api
+}
+
+// downloadClient returns the client for update downloads.
+func downloadClient() *http.Client {
+	return sharedHTTP.Load().download
+}
+
+// userAgent identifies the agent build, e.g. "tailstream-agent/1.4.0 (linux/amd64)".
+func userAgent() string {
+	return fmt.Sprintf("tailstream-agent/%s (%s/%s)", Version, runtime.GOOS, runtime.GOARCH)
+}
+
+// ingestUserAgent adds the host to userAgent, so the ingest side can tell
+// which agent sent a batch, e.g. "tailstream-agent/1.4.0 (linux/amd64; web-1)".
+func ingestUserAgent() string {
+	if m := hostMetadata.Load(); m != nil && m.Host != "" {
+		return fmt.Sprintf("tailstream-agent/%s (%s/%s; %s)", Version, runtime.GOOS, runtime.GOARCH, m.Host)
+	}
+	return userAgent()
+}
+
+// userAgentTransport sets the agent's User-Agent on requests that do not
+// carry one.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent())
+	}
+	return t.base.RoundTrip(req)
+}
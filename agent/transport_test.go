@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useHTTPConfig swaps in clients built from hc for the duration of a test.
+func useHTTPConfig(t *testing.T, hc HTTPConfig) {
+	t.Helper()
+	configureHTTP(hc)
+	t.Cleanup(func() { configureHTTP(HTTPConfig{}) })
+}
+
+func TestHTTPConfigDefaults(t *testing.T) {
+	hc := HTTPConfig{DialTimeout: 3 * time.Second}.withDefaults()
+	if hc.DialTimeout != 3*time.Second {
+		t.Errorf("expected the configured dial timeout to be kept, got %v", hc.DialTimeout)
+	}
+	if hc.RequestTimeout != 10*time.Second || hc.TLSHandshakeTimeout != 10*time.Second || hc.MaxIdleConnsPerHost != 4 {
+		t.Errorf("unexpected defaults: %+v", hc)
+	}
+}
+
+func TestIngestReusesConnections(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{})
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: srv.URL}
+	for i := 0; i < 5; i++ {
+		if err := shipEvents(context.Background(), stream, "token", accessLogEvents(10)); err != nil {
+			t.Fatalf("shipEvents %d failed: %v", i+1, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected five batches over one connection, got %d connections", n)
+	}
+}
+
+func TestIngestUserAgent(t *testing.T) {
+	saved := hostMetadata.Load()
+	defer hostMetadata.Store(saved)
+	setAgentMetadata(Config{Hostname: "web-1"})
+
+	var mu sync.Mutex
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: srv.URL}
+	if err := shipEvents(context.Background(), stream, "token", accessLogEvents(1)); err != nil {
+		t.Fatalf("shipEvents failed: %v", err)
+	}
+	resp, err := apiClient().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents) != 2 {
+		t.Fatalf("expected two requests, got %d", len(agents))
+	}
+	if want := "tailstream-agent/" + Version + " ("; !strings.HasPrefix(agents[0], want) || !strings.HasSuffix(agents[0], "; web-1)") {
+		t.Errorf("expected the ingest User-Agent to name the version and host, got %q", agents[0])
+	}
+	if agents[1] != userAgent() || strings.Contains(agents[1], "web-1") {
+		t.Errorf("expected other requests to carry the plain agent User-Agent, got %q", agents[1])
+	}
+}
+
+func TestHTTPUsesHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	for _, tt := range []struct {
+		disable bool
+		want    int
+	}{{false, 2}, {true, 1}} {
+		useHTTPConfig(t, HTTPConfig{DisableHTTP2: tt.disable})
+		sharedHTTP.Load().transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+		resp, err := apiClient().Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tt.want {
+			t.Errorf("disable_http2=%v: expected HTTP/%d, got %s", tt.disable, tt.want, resp.Proto)
+		}
+	}
+}
+
+func TestHTTPResponseHeaderTimeout(t *testing.T) {
+	useHTTPConfig(t, HTTPConfig{ResponseHeaderTimeout: 50 * time.Millisecond})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	stream := StreamConfig{Name: "app", StreamID: "test", URL: srv.URL}
+	if err := postPayload(context.Background(), stream, "token", encodeNDJSON(accessLogEvents(1)), nil); err == nil {
+		t.Fatal("expected a slow endpoint to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the response header timeout to apply, took %v", elapsed)
+	}
+}
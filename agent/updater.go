@@ -101,14 +101,14 @@ func getLatestRelease(channel string) (*GitHubRelease, error) {
 		url = fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", GitHubRepo)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := apiClient()
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("User-Agent", fmt.Sprintf("tailstream-agent/%s", Version))
+	req.Header.Set("User-Agent", userAgent())
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -232,7 +232,7 @@ func checkWritePermission(dir string) error {
 }
 
 func downloadFile(url, destination string) error {
-	resp, err := http.Get(url)
+	resp, err := downloadClient().Get(url)
 	if err != nil {
 		return err
 	}
@@ -254,7 +254,7 @@ func downloadFile(url, destination string) error {
 
 func verifyChecksum(filePath, checksumURL, filename string) error {
 	// Download checksums file
-	resp, err := http.Get(checksumURL)
+	resp, err := downloadClient().Get(checksumURL)
 	if err != nil {
 		return fmt.Errorf("failed to download checksums: %v", err)
 	}
@@ -0,0 +1,15 @@
+package main
+
+import "errors"
+
+// errWatchUnsupported means file change notifications are not available and
+// the tailer has to poll.
+var errWatchUnsupported = errors.New("file change notifications not supported")
+
+// fileWatcher signals when a tailed file may have changed: new data, a
+// rename, or the path being removed or created again. A signal is only a
+// hint; the tailer re-reads and re-checks the file to find out what happened.
+type fileWatcher interface {
+	Events() <-chan struct{}
+	Close() error
+}
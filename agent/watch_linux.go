@@ -0,0 +1,276 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Events on the tailed file itself
+	inotifyFileMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF
+	// Events in the parent directory, filtered down to the tailed name
+	inotifyDirMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+)
+
+// remoteFilesystems lists filesystem magic numbers where changes made by other
+// hosts never reach inotify, so polling has to be used instead.
+var remoteFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+}
+
+// inotify is the instance every watcher shares. The kernel allows a user
+// few instances (fs.inotify.max_user_instances, 128 by default) but many
+// watches, so one instance per tailed file would run out on a busy host.
+var inotify struct {
+	sync.Mutex
+	in *inotifyInstance
+}
+
+// inotifyInstance reads the events of the shared inotify descriptor and
+// hands them to the watchers of each watch descriptor. The kernel returns
+// the same watch descriptor for every watch on one inode, so a directory
+// holding several tailed files is watched once.
+type inotifyInstance struct {
+	fd int
+	f  *os.File
+	mu sync.Mutex // guards watches and the watch descriptors of its watchers
+	// watches maps each watch descriptor to the watchers using it
+	watches map[int32]map[*inotifyWatcher]bool
+}
+
+// sharedInotify returns the shared instance, creating it on first use or
+// after the previous one failed.
+func sharedInotify() (*inotifyInstance, error) {
+	inotify.Lock()
+	defer inotify.Unlock()
+	if inotify.in != nil {
+		return inotify.in, nil
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	in := &inotifyInstance{
+		fd: fd,
+		// A non-blocking descriptor wrapped by os.NewFile goes through the
+		// runtime poller, so reads block without tying up a thread
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]map[*inotifyWatcher]bool),
+	}
+	go in.readLoop()
+	inotify.in = in
+	return in, nil
+}
+
+// add watches path for w. Callers must hold in.mu.
+func (in *inotifyInstance) add(w *inotifyWatcher, path string, mask uint32) (int32, error) {
+	wd, err := syscall.InotifyAddWatch(in.fd, path, mask)
+	if err != nil {
+		return -1, err
+	}
+	watchers := in.watches[int32(wd)]
+	if watchers == nil {
+		watchers = make(map[*inotifyWatcher]bool)
+		in.watches[int32(wd)] = watchers
+	}
+	watchers[w] = true
+	return int32(wd), nil
+}
+
+// remove drops w from the watch wd, and the watch itself once no watcher
+// uses it any more. Callers must hold in.mu.
+func (in *inotifyInstance) remove(w *inotifyWatcher, wd int32) {
+	watchers, ok := in.watches[wd]
+	if !ok {
+		return
+	}
+	delete(watchers, w)
+	if len(watchers) == 0 {
+		delete(in.watches, wd)
+		syscall.InotifyRmWatch(in.fd, uint32(wd))
+	}
+}
+
+func (in *inotifyInstance) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := in.f.Read(buf)
+		if err != nil {
+			in.fail()
+			return
+		}
+
+		in.mu.Lock()
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + nameLen
+			if off > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[start:off]), "\x00")
+			in.dispatch(wd, mask, name)
+		}
+		in.mu.Unlock()
+	}
+}
+
+// dispatch hands an event to the watchers it concerns. Callers must hold in.mu.
+func (in *inotifyInstance) dispatch(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost; let every tailer re-check its file
+		for _, watchers := range in.watches {
+			for w := range watchers {
+				w.notify()
+			}
+		}
+		return
+	}
+	watchers := in.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		// The kernel dropped the watch, as the file was deleted
+		delete(in.watches, wd)
+	}
+	for w := range watchers {
+		w.handle(wd, mask, name)
+	}
+}
+
+// fail stops every watcher after the shared descriptor failed, so the
+// tailers fall back to polling, and lets the next watcher start afresh.
+func (in *inotifyInstance) fail() {
+	inotify.Lock()
+	if inotify.in == in {
+		inotify.in = nil
+	}
+	inotify.Unlock()
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	stopped := make(map[*inotifyWatcher]bool)
+	for _, watchers := range in.watches {
+		for w := range watchers {
+			if !stopped[w] {
+				stopped[w] = true
+				close(w.events)
+			}
+		}
+	}
+	in.watches = make(map[int32]map[*inotifyWatcher]bool)
+	in.f.Close()
+}
+
+// inotifyWatcher watches a file and its parent directory. The directory
+// watch catches the path being renamed away, deleted and created again; the
+// file watch catches appends.
+type inotifyWatcher struct {
+	in     *inotifyInstance
+	path   string
+	base   string
+	dirWd  int32
+	fileWd int32 // -1 while the path does not exist
+	events chan struct{}
+}
+
+// newFileWatcher starts watching file. It fails when the parent directory
+// cannot be watched or lives on a filesystem where inotify is unreliable.
+func newFileWatcher(file string) (fileWatcher, error) {
+	dir := filepath.Dir(file)
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return nil, err
+	}
+	if fs, ok := remoteFilesystems[uint32(st.Type)]; ok {
+		return nil, fmt.Errorf("%w on %s filesystem", errWatchUnsupported, fs)
+	}
+
+	in, err := sharedInotify()
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		in:     in,
+		path:   file,
+		base:   filepath.Base(file),
+		fileWd: -1,
+		events: make(chan struct{}, 1),
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if w.dirWd, err = in.add(w, dir, inotifyDirMask|syscall.IN_ONLYDIR); err != nil {
+		return nil, err
+	}
+	w.watchFile()
+	return w, nil
+}
+
+// Events returns the notification channel. It is closed if the watcher fails,
+// after which the caller should fall back to polling.
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	w.in.remove(w, w.dirWd)
+	if w.fileWd >= 0 {
+		w.in.remove(w, w.fileWd)
+	}
+	return nil
+}
+
+// watchFile (re)attaches the file watch to whatever inode the path now
+// names. Callers must hold w.in.mu.
+func (w *inotifyWatcher) watchFile() {
+	wd, err := w.in.add(w, w.path, inotifyFileMask)
+	if err != nil {
+		return
+	}
+	if w.fileWd >= 0 && w.fileWd != wd {
+		w.in.remove(w, w.fileWd)
+	}
+	w.fileWd = wd
+}
+
+// handle reacts to an event on one of w's watches. Callers must hold w.in.mu.
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	switch {
+	case wd == w.dirWd:
+		if name != w.base {
+			return
+		}
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			w.watchFile()
+		}
+	case wd == w.fileWd:
+		if mask&syscall.IN_IGNORED != 0 {
+			w.fileWd = -1
+		}
+	default:
+		return
+	}
+	w.notify()
+}
+
+func (w *inotifyWatcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
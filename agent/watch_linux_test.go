@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectWatchEvent(t *testing.T, w fileWatcher, what string) {
+	t.Helper()
+	select {
+	case _, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("watcher stopped while waiting for %s", what)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no notification for %s", what)
+	}
+}
+
+func TestFileWatcherNotifies(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newFileWatcher(file)
+	if err != nil {
+		t.Skipf("inotify not available here: %v", err)
+	}
+	defer w.Close()
+
+	appendFile(t, file, "first\n")
+	expectWatchEvent(t, w, "append")
+
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchEvent(t, w, "rename")
+
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchEvent(t, w, "create")
+
+	// The watch must follow the new file, not the renamed one
+	appendFile(t, file, "second\n")
+	expectWatchEvent(t, w, "append to the new file")
+}
+
+func TestFileWatcherIgnoresSiblings(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newFileWatcher(file)
+	if err != nil {
+		t.Skipf("inotify not available here: %v", err)
+	}
+	defer w.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, "other.log"), []byte("noise\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Events():
+		t.Fatal("notified for a file that is not watched")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestFileWatchersShareInotify watches more files than the default limit of
+// inotify instances allows, all in one directory: each watcher must still
+// hear about its own file only.
+func TestFileWatchersShareInotify(t *testing.T) {
+	dir := t.TempDir()
+	var watchers []fileWatcher
+	defer func() {
+		for _, w := range watchers {
+			w.Close()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("site%d.log", i))
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w, err := newFileWatcher(file)
+		if err != nil {
+			if i == 0 {
+				t.Skipf("inotify not available here: %v", err)
+			}
+			t.Fatalf("watcher %d: %v", i, err)
+		}
+		watchers = append(watchers, w)
+	}
+
+	// The shared directory watch may still deliver the creation of files
+	// watched later; like any notification it is only a hint
+	time.Sleep(100 * time.Millisecond)
+	for _, w := range watchers {
+		select {
+		case <-w.Events():
+		default:
+		}
+	}
+
+	appendFile(t, filepath.Join(dir, "site7.log"), "hello\n")
+	expectWatchEvent(t, watchers[7], "append")
+	select {
+	case <-watchers[8].Events():
+		t.Fatal("notified for another watcher's file")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// A closed watcher leaves the others sharing its directory watch alone
+	watchers[7].Close()
+	appendFile(t, filepath.Join(dir, "site8.log"), "hello\n")
+	expectWatchEvent(t, watchers[8], "append after a sibling closed")
+}
+
+// TestTailFileWakesOnWrite checks that a watched file is read well before the
+// poll interval would have picked the line up.
+func TestTailFileWakesOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := newFileWatcher(file); err != nil {
+		t.Skipf("inotify not available here: %v", err)
+	} else {
+		w.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan LogLine, 10)
+	go tailFile(ctx, "test", file, ch, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	appendFile(t, file, "hello\n")
+	select {
+	case ll := <-ch:
+		if ll.Line != "hello" {
+			t.Errorf("expected 'hello', got %q", ll.Line)
+		}
+		if elapsed := time.Since(start); elapsed >= pollInterval {
+			t.Errorf("line arrived after %v, no faster than polling", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("line was never read")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// newFileWatcher is only implemented on Linux; other platforms poll.
+func newFileWatcher(file string) (fileWatcher, error) {
+	return nil, errWatchUnsupported
+}
@@ -329,11 +329,14 @@ Type=simple
 User=$USER_NAME
 Group=$USER_NAME
 ExecStart=$BIN_DIR/$BINARY_NAME
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=5
+TimeoutStopSec=30
 StandardOutput=journal
 StandardError=journal
 SyslogIdentifier=tailstream-agent
+StateDirectory=tailstream
 
 # Security settings
 NoNewPrivileges=yes